@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/prettytime"
+)
+
+// SavedSearch is a query that is checked against every newly scraped page.
+type SavedSearch struct {
+	ID    int64
+	Name  string
+	Query string
+	// Webhook, if set, receives a POST for every match.
+	Webhook string
+}
+
+// Alert records a newly scraped page matching a saved search.
+type Alert struct {
+	ID         int64
+	Search     SavedSearch
+	PageID     int64
+	URL        string
+	SafeTitle  template.HTML
+	MatchedAt  time.Time
+	MatchedAgo string
+	Seen       bool
+	// PageExists is false if the page has since been evicted or deleted.
+	PageExists bool
+}
+
+func (db *DB) SaveSearch(s SavedSearch) (int64, error) {
+	// Make sure the query is valid before we try it on every page.
+	if _, err := db.hasMatch(s.Query); err != nil {
+		return 0, fmt.Errorf("invalid query %q: %w", s.Query, err)
+	}
+	res, err := db.Exec(`INSERT INTO saved_searches(name, query, webhook, created_at) VALUES (?, ?, ?, ?)`,
+		s.Name, s.Query, s.Webhook, time.Now().Format(ISO8601TZ))
+	if err != nil {
+		return 0, fmt.Errorf("failed to save search: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+func (db *DB) DeleteSearch(id int64) error {
+	if _, err := db.Exec(`DELETE FROM saved_searches WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete search: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) SavedSearches() ([]SavedSearch, error) {
+	rows, err := db.read.Query(`SELECT id, name, query, webhook FROM saved_searches ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var searches []SavedSearch
+	for rows.Next() {
+		var s SavedSearch
+		if err := rows.Scan(&s.ID, &s.Name, &s.Query, &s.Webhook); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		searches = append(searches, s)
+	}
+	return searches, rows.Err()
+}
+
+// MatchSavedSearches checks a newly saved page against every saved search and
+// records an alert for each match. A URL only alerts once per search, so
+// revisiting a page doesn't alert again.
+func (db *DB) MatchSavedSearches(id int64, col DataColumn) ([]Alert, error) {
+	searches, err := db.SavedSearches()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var alerts []Alert
+	for _, s := range searches {
+		var matched bool
+		err := db.read.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM search_index WHERE search_index MATCH ? AND rowid = ?
+		) AND NOT EXISTS (
+			SELECT 1 FROM search_alerts WHERE search_id = ? AND url = ?
+		)`, s.Query, id, s.ID, col.URL).Scan(&matched)
+		if err != nil {
+			log.Warnf("Failed to check saved search %q: %v", s.Name, err)
+			continue
+		}
+		if !matched {
+			continue
+		}
+
+		res, err := db.Exec(`INSERT INTO search_alerts(search_id, page_id, url, title, matched_at) VALUES (?, ?, ?, ?, ?)`,
+			s.ID, id, col.URL, db.seal("title", col.SafeTitle), now.Format(ISO8601TZ))
+		if err != nil {
+			return alerts, fmt.Errorf("failed to record alert for %q: %w", s.Name, err)
+		}
+		alertID, _ := res.LastInsertId()
+		alerts = append(alerts, Alert{
+			ID:         alertID,
+			Search:     s,
+			PageID:     id,
+			URL:        col.URL,
+			SafeTitle:  col.SafeTitle,
+			MatchedAt:  now,
+			PageExists: true,
+		})
+	}
+	return alerts, nil
+}
+
+// Alerts lists the most recent alerts, newest first.
+func (db *DB) Alerts(limit int) ([]Alert, error) {
+	rows, err := db.read.Query(`
+	SELECT
+		a.id, a.page_id, a.url, a.title, a.matched_at, a.seen,
+		s.id, s.name, s.query, s.webhook,
+		EXISTS (SELECT 1 FROM web_data WHERE web_data.id = a.page_id AND `+notTrashed+`)
+	FROM search_alerts a
+	INNER JOIN saved_searches s ON a.search_id = s.id
+	ORDER BY a.id DESC
+	LIMIT ?`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var alerts []Alert
+	for rows.Next() {
+		var a Alert
+		var matchTime string
+		if err := rows.Scan(&a.ID, &a.PageID, &a.URL, db.opened("title", &a.SafeTitle), &matchTime, &a.Seen,
+			&a.Search.ID, &a.Search.Name, &a.Search.Query, &a.Search.Webhook,
+			&a.PageExists); err != nil {
+			return nil, fmt.Errorf("alert %d: scan: %w", len(alerts), err)
+		}
+		t, err := timeFromDB(matchTime)
+		if err != nil {
+			return nil, fmt.Errorf("alert %d: %w", len(alerts), err)
+		}
+		a.MatchedAt = t
+		a.MatchedAgo = prettytime.DurationBetween(now, t)
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+func (db *DB) UnseenAlerts() (int, error) {
+	var n int
+	err := db.read.QueryRow(`SELECT count(*) FROM search_alerts WHERE NOT seen`).Scan(&n)
+	return n, err
+}
+
+func (db *DB) MarkAlertsSeen() error {
+	if _, err := db.Exec(`UPDATE search_alerts SET seen = true WHERE NOT seen`); err != nil {
+		return fmt.Errorf("failed to mark alerts seen: %w", err)
+	}
+	return nil
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type webhookPayload struct {
+	Search string `json:"search"`
+	Query  string `json:"query"`
+	ID     int64  `json:"id"`
+	URL    string `json:"url"`
+	Title  string `json:"title"`
+}
+
+// fireWebhook posts the alert to its search's webhook, if it has one. It is
+// meant to be run in the background.
+func fireWebhook(a Alert) {
+	if a.Search.Webhook == "" {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{
+		Search: a.Search.Name,
+		Query:  a.Search.Query,
+		ID:     a.PageID,
+		URL:    a.URL,
+		Title:  html.UnescapeString(string(a.SafeTitle)),
+	})
+	if err != nil {
+		log.Errorf("Failed to encode webhook for %q: %v", a.Search.Name, err)
+		return
+	}
+	resp, err := webhookClient.Post(a.Search.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("Webhook for %q failed: %v", a.Search.Name, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warnf("Webhook for %q returned %s", a.Search.Name, resp.Status)
+	}
+}
+
+func makeInbox(store AlertStore) func(w http.ResponseWriter, r *http.Request) {
+	inboxTemplate := template.Must(template.ParseFS(staticContent, "static/inbox.template.html"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		searches, err := store.SavedSearches()
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("inbox: failed to query saved searches: %v", err)
+			return
+		}
+		alerts, err := store.Alerts(100)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("inbox: failed to query alerts: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if err := inboxTemplate.Execute(w, map[string]any{
+			"Root":     prefix,
+			"Searches": searches,
+			"Alerts":   alerts,
+		}); err != nil {
+			log.Errorf("failed to render inbox: %v", err)
+		}
+	}
+}
+
+func makePostSavedSearch(store AlertStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := SavedSearch{
+			Name:    r.FormValue("name"),
+			Query:   r.FormValue("q"),
+			Webhook: r.FormValue("webhook"),
+		}
+		if s.Query == "" {
+			http.Error(w, "Missing query", http.StatusBadRequest)
+			return
+		}
+		if s.Name == "" {
+			s.Name = s.Query
+		}
+		if _, err := store.SaveSearch(s); err != nil {
+			log.Infof("Failed to save search %q: %v", s.Query, err)
+			http.Error(w, fmt.Sprintf("Failed to save search: %v", err), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, prefix+"/inbox", http.StatusFound)
+	}
+}
+
+func makeDeleteSavedSearch(store AlertStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		if err := store.DeleteSearch(int64(id)); err != nil {
+			log.Warnf("Failed to delete saved search %d: %v", id, err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, prefix+"/inbox", http.StatusFound)
+	}
+}
+
+func makeMarkAlertsSeen(store AlertStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := store.MarkAlertsSeen(); err != nil {
+			log.Warnf("Failed to mark alerts seen: %v", err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, prefix+"/inbox", http.StatusFound)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// apiResult is a search result as presented by the JSON API. The title is
+// plain text, the blurb is HTML with matches in <b> tags. The full page content
+// is left out.
+type apiResult struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Title     string    `json:"title"`
+	Blurb     string    `json:"blurb"`
+	ScrapedAt time.Time `json:"scraped_at"`
+}
+
+type apiSearchResponse struct {
+	Query string `json:"query,omitempty"`
+	// Next and Prev are cursors for the neighbouring pages, omitted if there
+	// are none. An empty cursor is the first page.
+	Next       *string     `json:"next,omitempty"`
+	Prev       *string     `json:"prev,omitempty"`
+	Total      int         `json:"total"`
+	Estimated  bool        `json:"estimated,omitempty"`
+	TookMS     float64     `json:"took_ms"`
+	Results    []apiResult `json:"results"`
+	Facets     *Facets     `json:"facets,omitempty"`
+	Suggestion string      `json:"suggestion,omitempty"`
+	Corrected  string      `json:"corrected,omitempty"`
+}
+
+func toAPIResult(r SearchResult) apiResult {
+	return apiResult{
+		ID:        r.ID,
+		URL:       r.URL,
+		Title:     html.UnescapeString(string(r.SafeTitle)),
+		Blurb:     string(r.SafeBlurb),
+		ScrapedAt: r.ScrapedAt,
+	}
+}
+
+func newAPISearchResponse(page SearchPage, took time.Duration) apiSearchResponse {
+	resp := apiSearchResponse{
+		Next:      apiCursor(page.Next),
+		Prev:      apiCursor(page.Prev),
+		Total:     page.Total,
+		Estimated: page.Estimated,
+		TookMS:    float64(took.Microseconds()) / 1000,
+		Results:   make([]apiResult, len(page.Results)),
+		Facets:    page.Facets,
+	}
+	for i, result := range page.Results {
+		resp.Results[i] = toAPIResult(result)
+	}
+	return resp
+}
+
+func apiCursor(c *Cursor) *string {
+	if c == nil {
+		return nil
+	}
+	s := c.String()
+	return &s
+}
+
+// makeSearchAPI serves the same searches as the search page as JSON. Facets
+// are included when the form value "facets" is true.
+func makeSearchAPI(store Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := searchFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.WithFacets = r.FormValue("facets") == "true"
+		out, err := runSearch(store, q)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("search api: failed to query for %q: %v", q.Query, err)
+			return
+		}
+
+		resp := newAPISearchResponse(out.SearchPage, out.Took)
+		resp.Query = q.Query
+		resp.Suggestion = out.Suggestion
+		resp.Corrected = out.Corrected
+		writeJSON(w, resp)
+	}
+}
+
+// makeHistoryAPI serves the history page as JSON.
+func makeHistoryAPI(store Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, limit, err := historyFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		start := time.Now()
+		page, err := store.History(from, limit)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("history api: failed to query: %v", err)
+			return
+		}
+		writeJSON(w, newAPISearchResponse(page, time.Since(start)))
+	}
+}
+
+// writeJSON writes v as the response, with a JSON content type unless one was
+// already set.
+func writeJSON(w http.ResponseWriter, v any) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("failed to write JSON response: %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/auth"
+	"github.com/spencer-p/palace/pkg/sealed"
+)
+
+// backupConfig is where and how backups are written, set by the BACKUP_
+// variables.
+var backupConfig = backupConfigFromEnv()
+
+// backupInterval is how often backups are made, or never if zero.
+var backupInterval = envDuration("BACKUP_INTERVAL", 0)
+
+// backupTimeFormat names backup files, which sort by name in time order.
+const backupTimeFormat = "20060102T150405Z"
+
+// BackupConfig decides where backups go and how many are kept.
+type BackupConfig struct {
+	Dir string
+	// Key encrypts backups with AES-GCM if set.
+	Key []byte
+	// Keep is the number of backups kept, or all of them if zero.
+	Keep int
+	// MaxAge deletes backups older than this, or none if zero. The newest
+	// backup is never deleted.
+	MaxAge time.Duration
+}
+
+func backupConfigFromEnv() BackupConfig {
+	c := BackupConfig{
+		Dir:    os.Getenv("BACKUP_DIR"),
+		Keep:   envInt("BACKUP_KEEP", 7),
+		MaxAge: envDuration("BACKUP_MAX_AGE", 0),
+	}
+	if key := os.Getenv("BACKUP_KEY"); key != "" {
+		c.Key = auth.MustDecodeBase64([]byte(key))
+		switch len(c.Key) {
+		case 16, 24, 32:
+			// OK.
+		default:
+			// Better not to start than to write backups in the clear.
+			log.Fatalf("BACKUP_KEY is invalid length %d", len(c.Key))
+		}
+	}
+	return c
+}
+
+// BackupFile is a backup in the backup directory.
+type BackupFile struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Encrypted bool      `json:"encrypted"`
+}
+
+// parseBackupName reads the time and encryption of a backup from its name,
+// such as palace-20240601T120000Z.db.gz.enc.
+func parseBackupName(name string) (BackupFile, bool) {
+	rest, ok := strings.CutPrefix(name, "palace-")
+	if !ok {
+		return BackupFile{}, false
+	}
+	rest, encrypted := strings.CutSuffix(rest, ".enc")
+	stamp, ok := strings.CutSuffix(rest, ".db.gz")
+	if !ok {
+		return BackupFile{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, stamp)
+	if err != nil {
+		return BackupFile{}, false
+	}
+	return BackupFile{Name: name, CreatedAt: t, Encrypted: encrypted}, true
+}
+
+// Snapshot writes a consistent copy of the database to a new file without
+// blocking writers.
+func (db *DB) Snapshot(path string) error {
+	if _, err := db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to snapshot: %w", err)
+	}
+	return nil
+}
+
+// Backup snapshots the database into a compressed, and maybe encrypted, file
+// in the backup directory, then rotates old backups out.
+func (c BackupConfig) Backup(store Snapshotter) (BackupFile, error) {
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return BackupFile{}, err
+	}
+	now := time.Now().UTC()
+	name := "palace-" + now.Format(backupTimeFormat) + ".db.gz"
+	if c.Key != nil {
+		name += ".enc"
+	}
+	path := filepath.Join(c.Dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return BackupFile{}, fmt.Errorf("backup %s already exists", name)
+	}
+
+	snapshot := filepath.Join(c.Dir, ".snapshot-"+now.Format(backupTimeFormat))
+	defer os.Remove(snapshot)
+	if err := store.Snapshot(snapshot); err != nil {
+		return BackupFile{}, err
+	}
+
+	// Write under a temporary name so a half written backup is never
+	// mistaken for a whole one.
+	partial := path + ".partial"
+	defer os.Remove(partial)
+	if err := c.pack(snapshot, partial); err != nil {
+		return BackupFile{}, err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return BackupFile{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	if _, err := c.Rotate(); err != nil {
+		log.Warnf("Failed to rotate backups: %v", err)
+	}
+	return BackupFile{Name: name, Size: info.Size(), CreatedAt: now, Encrypted: c.Key != nil}, nil
+}
+
+// pack compresses, and maybe encrypts, the file at src into a new file at dst.
+func (c BackupConfig) pack(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w, err := c.packWriter(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return fmt.Errorf("failed to compress: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// packWriter compresses, and encrypts if there is a key, everything written
+// to it into w. Closing it doesn't close w.
+func (c BackupConfig) packWriter(w io.Writer) (io.WriteCloser, error) {
+	if c.Key == nil {
+		return gzip.NewWriter(w), nil
+	}
+	seal, err := sealed.NewWriter(w, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	return packCloser{gzip.NewWriter(seal), seal}, nil
+}
+
+// packCloser closes the gzip writer, then the encryption under it.
+type packCloser struct {
+	*gzip.Writer
+	seal *sealed.Writer
+}
+
+func (p packCloser) Close() error {
+	if err := p.Writer.Close(); err != nil {
+		return err
+	}
+	return p.seal.Close()
+}
+
+// unpack reverses pack.
+func (c BackupConfig) unpack(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	r, err := c.unpackReader(in, strings.HasSuffix(src, ".enc"))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		return fmt.Errorf("failed to decompress: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// unpackReader reverses packWriter.
+func (c BackupConfig) unpackReader(r io.Reader, encrypted bool) (io.Reader, error) {
+	if encrypted {
+		if c.Key == nil {
+			return nil, errors.New("backup is encrypted but BACKUP_KEY is not set")
+		}
+		var err error
+		if r, err = sealed.NewReader(r, c.Key); err != nil {
+			return nil, err
+		}
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	return zr, nil
+}
+
+// List lists the backups in the backup directory, newest first.
+func (c BackupConfig) List() ([]BackupFile, error) {
+	entries, err := os.ReadDir(c.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []BackupFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := []BackupFile{}
+	for _, e := range entries {
+		b, ok := parseBackupName(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			b.Size = info.Size()
+		}
+		backups = append(backups, b)
+	}
+	slices.SortFunc(backups, func(a, b BackupFile) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return backups, nil
+}
+
+// Rotate deletes the backups beyond Keep or older than MaxAge, always keeping
+// the newest one. It returns the names of the backups deleted.
+func (c BackupConfig) Rotate() ([]string, error) {
+	backups, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	now := time.Now()
+	for i, b := range backups {
+		tooMany := c.Keep > 0 && i >= c.Keep
+		tooOld := c.MaxAge > 0 && now.Sub(b.CreatedAt) > c.MaxAge
+		if i == 0 || !(tooMany || tooOld) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.Dir, b.Name)); err != nil {
+			return deleted, err
+		}
+		log.Infof("Deleted old backup %s", b.Name)
+		deleted = append(deleted, b.Name)
+	}
+	return deleted, nil
+}
+
+// Restore replaces the database at dbFile with a backup, which is either a
+// path or the name of a file in the backup directory. The backup is unpacked
+// and checked before anything is replaced, and the old database is kept next
+// to the new one. Palace must not be running.
+func (c BackupConfig) Restore(backup, dbFile string) error {
+	if !strings.ContainsRune(backup, filepath.Separator) {
+		backup = filepath.Join(c.Dir, backup)
+	}
+	restored := dbFile + ".restoring"
+	os.Remove(restored)
+	defer os.Remove(restored)
+	if err := c.unpack(backup, restored); err != nil {
+		return fmt.Errorf("failed to unpack %s: %w", backup, err)
+	}
+	if err := checkRestored(restored); err != nil {
+		return fmt.Errorf("%s is not a good backup: %w", backup, err)
+	}
+	return swapIn(restored, dbFile)
+}
+
+// swapIn replaces the database at dbFile with the one at restored, keeping the
+// old one next to it.
+func swapIn(restored, dbFile string) error {
+	if _, err := os.Stat(dbFile); err == nil {
+		old := dbFile + ".before-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		if err := os.Rename(dbFile, old); err != nil {
+			return fmt.Errorf("failed to move the old database aside: %w", err)
+		}
+		// The old write-ahead log may have transactions that never made it
+		// into the old database, after a crash say, so it goes with it.
+		if err := os.Rename(dbFile+"-wal", old+"-wal"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to move the old write-ahead log aside: %w", err)
+		}
+		log.Infof("Moved the old database to %s", old)
+	}
+	// The shared memory index is rebuilt from the log, and anything left
+	// without a database to go with doesn't belong to the new one.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbFile + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(restored, dbFile)
+}
+
+// checkRestored makes sure an unpacked backup is a healthy database that this
+// version of Palace can open.
+func checkRestored(path string) error {
+	db, err := OpenDB(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check: %s", result)
+	}
+	if _, err := db.PendingMigrations(); err != nil {
+		return err
+	}
+	if _, err := maintenanceOps["integrity-check"].Run(db); err != nil {
+		return err
+	}
+	// Checkpoint so that the restored file stands alone.
+	if _, err := maintenanceOps["checkpoint"].Run(db); err != nil {
+		return err
+	}
+	return nil
+}
+
+// runBackups backs up the store every interval. It is meant to be run in the
+// background.
+func runBackups(store Snapshotter, c BackupConfig, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		start := time.Now()
+		b, err := c.Backup(store)
+		if err != nil {
+			log.Errorf("Failed to back up: %v", err)
+			continue
+		}
+		log.Infof("Backed up to %s (%d bytes) in %v", b.Name, b.Size, time.Since(start))
+	}
+}
+
+// makeBackups lists the backups.
+func makeBackups(store Snapshotter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if backupConfig.Dir == "" {
+			http.Error(w, "BACKUP_DIR is not set", http.StatusNotImplemented)
+			return
+		}
+		backups, err := backupConfig.List()
+		if err != nil {
+			http.Error(w, "Failed to list backups", http.StatusInternalServerError)
+			log.Infof("backups: failed to list: %v", err)
+			return
+		}
+		writeJSON(w, backups)
+	}
+}
+
+// makePostBackup makes a backup now.
+func makePostBackup(store Snapshotter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if backupConfig.Dir == "" {
+			http.Error(w, "BACKUP_DIR is not set", http.StatusNotImplemented)
+			return
+		}
+		b, err := backupConfig.Backup(store)
+		if err != nil {
+			log.Errorf("Failed to back up: %v", err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Backed up to %s (%d bytes)", b.Name, b.Size)
+		writeJSON(w, b)
+	}
+}
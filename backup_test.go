@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// copyFile copies src to dst, as a crash would leave it on disk.
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// savedURLs lists the URLs of the pages in the database at path.
+func savedURLs(t *testing.T, path string) []string {
+	t.Helper()
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	rows, err := db.read.Query(`SELECT url FROM web_data ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// TestRestoreKeepsLog checks that transactions only in the write-ahead log of
+// the database being replaced, as after a crash, are kept with it.
+func TestRestoreKeepsLog(t *testing.T) {
+	config := BackupConfig{Dir: t.TempDir()}
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"), replicaPragmas...)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	mustSave(t, db, testPage("https://a.com/", "A", "backed up"))
+	backup, err := config.Backup(db)
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	mustSave(t, db, testPage("https://b.com/", "B", "only in the log"))
+
+	file, err := db.filename()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := filepath.Join(t.TempDir(), "palace.db")
+	copyFile(t, file, crashed)
+	copyFile(t, file+"-wal", crashed+"-wal")
+
+	if err := config.Restore(backup.Name, crashed); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got, want := savedURLs(t, crashed), []string{"https://a.com/"}; !slices.Equal(got, want) {
+		t.Errorf("restored %q, wanted %q", got, want)
+	}
+	old, err := filepath.Glob(crashed + ".before-restore-*[0-9]Z")
+	if err != nil || len(old) != 1 {
+		t.Fatalf("found old databases %q: %v", old, err)
+	}
+	if got, want := savedURLs(t, old[0]), []string{"https://a.com/", "https://b.com/"}; !slices.Equal(got, want) {
+		t.Errorf("the old database has %q, wanted %q", got, want)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		key  []byte
+	}{
+		{"plain", nil},
+		{"encrypted", testKey(3)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := BackupConfig{Dir: t.TempDir(), Key: tc.key}
+			db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+			if err != nil {
+				t.Fatalf("NewDB: %v", err)
+			}
+			defer db.Close()
+			mustSave(t, db, testPage("https://a.com/", "A", "first page"))
+			mustSave(t, db, testPage("https://b.com/", "B", "second page"))
+
+			backup, err := config.Backup(db)
+			if err != nil {
+				t.Fatalf("Backup: %v", err)
+			}
+			if backup.Encrypted != (tc.key != nil) || strings.HasSuffix(backup.Name, ".enc") != (tc.key != nil) {
+				t.Errorf("backup = %+v", backup)
+			}
+			list, err := config.List()
+			if err != nil || len(list) != 1 || list[0].Name != backup.Name || list[0].Size != backup.Size {
+				t.Errorf("List = %+v, %v, wanted %+v", list, err, backup)
+			}
+
+			restored := filepath.Join(t.TempDir(), "palace.db")
+			if err := config.Restore(backup.Name, restored); err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+			if got, want := savedURLs(t, restored), []string{"https://a.com/", "https://b.com/"}; !slices.Equal(got, want) {
+				t.Errorf("restored %q, wanted %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	now := time.Now().UTC()
+	// Newest first.
+	var names []string
+	for _, age := range []time.Duration{time.Hour, 25 * time.Hour, 49 * time.Hour, 73 * time.Hour} {
+		names = append(names, "palace-"+now.Add(-age).Format(backupTimeFormat)+".db.gz")
+	}
+
+	table := []struct {
+		name   string
+		config BackupConfig
+		kept   []string
+	}{
+		{"keep all", BackupConfig{}, names},
+		{"keep", BackupConfig{Keep: 2}, names[:2]},
+		{"max age", BackupConfig{MaxAge: 48 * time.Hour}, names[:2]},
+		{"both", BackupConfig{Keep: 3, MaxAge: 72 * time.Hour}, names[:3]},
+		// The newest backup is kept even if it is too old.
+		{"newest", BackupConfig{MaxAge: time.Minute}, names[:1]},
+	}
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Dir = t.TempDir()
+			for _, name := range names {
+				if err := os.WriteFile(filepath.Join(tc.config.Dir, name), []byte("backup"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Other files are left alone.
+			if err := os.WriteFile(filepath.Join(tc.config.Dir, "notes.txt"), nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			deleted, err := tc.config.Rotate()
+			if err != nil {
+				t.Fatalf("Rotate: %v", err)
+			}
+			if len(deleted) != len(names)-len(tc.kept) {
+				t.Errorf("deleted %q", deleted)
+			}
+			list, err := tc.config.List()
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			var kept []string
+			for _, b := range list {
+				kept = append(kept, b.Name)
+			}
+			if !slices.Equal(kept, tc.kept) {
+				t.Errorf("kept %q, wanted %q", kept, tc.kept)
+			}
+			if _, err := os.Stat(filepath.Join(tc.config.Dir, "notes.txt")); err != nil {
+				t.Errorf("rotation deleted another file: %v", err)
+			}
+		})
+	}
+}
+
+// TestRestoreRejects checks that bad backups are caught before the database
+// is touched.
+func TestRestoreRejects(t *testing.T) {
+	config := BackupConfig{Dir: t.TempDir(), Key: testKey(3)}
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	mustSave(t, db, testPage("https://a.com/", "A", strings.Repeat("enough to compress ", 1000)))
+	backup, err := config.Backup(db)
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	good, err := os.ReadFile(filepath.Join(config.Dir, backup.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	truncated := filepath.Join(dir, backup.Name)
+	if err := os.WriteFile(truncated, good[:len(good)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Compressed fine, but not a database.
+	notDB := filepath.Join(dir, "palace-20240101T000000Z.db.gz")
+	if err := (BackupConfig{}).pack(writeTemp(t, "not a database"), notDB); err != nil {
+		t.Fatal(err)
+	}
+
+	dbFile := filepath.Join(t.TempDir(), "palace.db")
+	if err := os.WriteFile(dbFile, []byte("the live database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		name   string
+		config BackupConfig
+		backup string
+	}{
+		{"truncated", config, truncated},
+		{"wrong key", BackupConfig{Dir: config.Dir, Key: testKey(4)}, backup.Name},
+		{"no key", BackupConfig{Dir: config.Dir}, backup.Name},
+		{"not a database", config, notDB},
+	}
+	for _, tc := range table {
+		if err := tc.config.Restore(tc.backup, dbFile); err == nil {
+			t.Errorf("%s: restored a bad backup", tc.name)
+		}
+		if data, err := os.ReadFile(dbFile); err != nil || !bytes.Equal(data, []byte("the live database")) {
+			t.Errorf("%s: the database was touched: %q, %v", tc.name, data, err)
+		}
+		if others, _ := filepath.Glob(dbFile + ".*"); len(others) > 0 {
+			t.Errorf("%s: left %q behind", tc.name, others)
+		}
+	}
+}
+
+// writeTemp writes data to a new file and returns its path.
+func writeTemp(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -10,6 +10,7 @@ import (
 )
 
 func main() {
+	auth.Setup()
 	fmt.Printf("%s", b64(auth.SaltAndHash(os.Args[1])))
 }
 
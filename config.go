@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// envFloat reads a float setting from the environment, falling back to def if
+// it is unset or malformed.
+func envFloat(name string, def float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Warnf("Ignoring %s=%q: %v", name, raw, err)
+		return def
+	}
+	return f
+}
+
+// envBool reads a boolean setting from the environment, falling back to def if
+// it is unset or malformed.
+func envBool(name string, def bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Warnf("Ignoring %s=%q: %v", name, raw, err)
+		return def
+	}
+	return b
+}
+
+// envInt reads an integer setting from the environment, falling back to def if
+// it is unset or malformed.
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	i, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Warnf("Ignoring %s=%q: %v", name, raw, err)
+		return def
+	}
+	return i
+}
+
+// envDuration reads a duration setting from the environment, which may also be
+// a number of days like "30d", falling back to def if it is unset or malformed.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	d, err := parseDays(raw)
+	if err != nil {
+		log.Warnf("Ignoring %s=%q: %v", name, raw, err)
+		return def
+	}
+	return d
+}
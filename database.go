@@ -6,14 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/log"
-	"github.com/spencer-p/palace/pkg/backoff"
+	"github.com/spencer-p/palace/pkg/embed"
+	"github.com/spencer-p/palace/pkg/keyring"
 	"github.com/spencer-p/palace/pkg/prettytime"
-	"modernc.org/sqlite"
 	_ "modernc.org/sqlite"
-	sqlite3 "modernc.org/sqlite/lib"
 )
 
 type DataColumn struct {
@@ -28,28 +31,171 @@ type SearchResult struct {
 	ID         int
 	SafeBlurb  template.HTML
 	ScrapedAgo string
+	// Pinned pages are kept by retention rules. It is only set by Fetch.
+	Pinned bool
 }
 
 type DB struct {
+	// DB is the pool for writes. It has a single connection, so writers in
+	// this process queue up here rather than in SQLite's busy handler, and
+	// its transactions start with BEGIN IMMEDIATE so they never fail to
+	// upgrade a read lock to a write lock.
 	*sql.DB
+
+	// read is the pool for queries. Its connections are read-only, and in WAL
+	// mode they neither wait for the writer nor hold it up.
+	read *sql.DB
+
+	// stmts are prepared once on their pool and reused across requests.
+	stmts *stmtCache
+
+	// Weights are the bm25 weights given to each indexed column when ranking
+	// search results.
+	Weights ColumnWeights
+
+	// Embedder computes the vectors used by hybrid search. If nil, pages are
+	// not embedded and searches only use the full text index.
+	Embedder embed.Embedder
+
+	// Keys, if set, encrypt titles and content at rest. See ApplyKeys.
+	Keys *keyring.Keyring
+
+	// contentless is set when the search index keeps no copy of the pages it
+	// indexes, and Save has to fill it in.
+	contentless bool
+
+	// replica, if set, ships the write-ahead log and owns checkpoints.
+	replica *Replicator
+}
+
+// ColumnWeights are relative bm25 weights for the columns of search_index.
+type ColumnWeights struct {
+	Content float64
+	Title   float64
+}
+
+// DefaultWeights favors title matches, which are almost always what we're
+// looking for.
+var DefaultWeights = ColumnWeights{
+	Content: 1.0,
+	Title:   10.0,
 }
 
-//go:embed init_db.sql
-var initDB string
+//go:embed pragmas.sql
+var pragmas string
 
-func NewDB(filename string) (DB, error) {
-	db, err := sql.Open("sqlite", filename)
+// NewDB opens the database and brings its schema up to date.
+func NewDB(filename string, connPragmas ...string) (*DB, error) {
+	db, err := OpenDB(filename, connPragmas...)
 	if err != nil {
-		return DB{}, fmt.Errorf("failed to open %q: %v", filename, err)
+		return nil, err
+	}
+	if err := db.Migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	if db.contentless, err = db.indexIsContentless(); err != nil {
+		db.Close()
+		return nil, err
 	}
+	return db, nil
+}
 
-	_, err = db.Exec(initDB)
+// OpenDB opens the database without touching its schema. Unlike the settings in
+// pragmas.sql, connPragmas such as "wal_autocheckpoint(0)" are applied to every
+// connection in both pools.
+func OpenDB(filename string, connPragmas ...string) (*DB, error) {
+	params := url.Values{"_pragma": connPragmas, "_txlock": {"immediate"}}
+	db, err := sql.Open("sqlite", sqliteURI(filename, params))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %v", filename, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(pragmas)
 	if err != nil {
 		db.Close()
-		return DB{}, fmt.Errorf("failed to run database init script: %v", err)
+		return nil, fmt.Errorf("failed to set pragmas: %v", err)
 	}
 
-	return DB{db}, nil
+	// The writer has created the database and switched it to WAL mode by now,
+	// which read-only connections can't do themselves.
+	params = url.Values{
+		"mode":    {"ro"},
+		"_pragma": append([]string{"query_only(true)", "busy_timeout(30000)", "temp_store(memory)"}, connPragmas...),
+	}
+	read, err := sql.Open("sqlite", sqliteURI(filename, params))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open %q for reading: %v", filename, err)
+	}
+	if err := read.Ping(); err != nil {
+		db.Close()
+		read.Close()
+		return nil, fmt.Errorf("failed to open %q for reading: %v", filename, err)
+	}
+
+	return &DB{
+		DB:       db,
+		read:     read,
+		stmts:    &stmtCache{},
+		Weights:  DefaultWeights,
+		Embedder: embed.NewHashed(embedDims),
+	}, nil
+}
+
+// sqliteURI makes a file: URI for the driver, which only passes query
+// parameters like mode on to SQLite for URIs.
+func sqliteURI(filename string, params url.Values) string {
+	return "file:" + (&url.URL{Path: filename}).EscapedPath() + "?" + params.Encode()
+}
+
+// Close closes both pools and the statements prepared on them.
+func (db *DB) Close() error {
+	db.stmts.close()
+	return errors.Join(db.read.Close(), db.DB.Close())
+}
+
+// stmtCache holds statements prepared on a pool, keyed by their SQL. It is
+// only meant for queries with fixed text, not ones built per request.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[*sql.DB]map[string]*sql.Stmt
+}
+
+// stmt prepares the query on the pool the first time it is asked for, and
+// returns the same statement after that. database/sql prepares it again on
+// each connection that runs it.
+func (db *DB) stmt(pool *sql.DB, query string) (*sql.Stmt, error) {
+	c := db.stmts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.stmts[pool][query]; ok {
+		return s, nil
+	}
+	s, err := pool.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if c.stmts == nil {
+		c.stmts = make(map[*sql.DB]map[string]*sql.Stmt)
+	}
+	if c.stmts[pool] == nil {
+		c.stmts[pool] = make(map[string]*sql.Stmt)
+	}
+	c.stmts[pool][query] = s
+	return s, nil
+}
+
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, stmts := range c.stmts {
+		for _, s := range stmts {
+			s.Close()
+		}
+	}
+	c.stmts = nil
 }
 
 const (
@@ -57,132 +203,395 @@ const (
 	ISO8601TZ = "2006-01-02 15:04:05.000-07:00"
 )
 
-func retryBusy(err error) bool {
-	sqliteErr := &sqlite.Error{}
-	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_BUSY
-}
-
 func (db *DB) Save(col DataColumn) (int64, error) {
-	var res sql.Result
-	if err := backoff.Retry(5, retryBusy, func() error {
-		var err error
-		res, err = db.Exec(`INSERT INTO web_data(url, scraped_at, title, content) VALUES (?, ?, ?, ?) RETURNING id`,
-			col.URL,
-			col.ScrapedAt.Format(ISO8601TZ),
-			col.SafeTitle,
-			col.SafeContent,
-		)
-		return err
-	}); err != nil {
+	id, err := db.insert(col)
+	if err != nil {
 		return 0, err
 	}
 
-	err := db.Evict(col.URL)
+	err = db.Evict(col.URL)
 	if err != nil {
 		log.Warnf("failed to evict old entries for %q: %v", col.URL, err)
 	}
 
-	return res.LastInsertId()
+	if db.Embedder != nil {
+		if err := db.embedPage(id, col.SafeTitle, col.SafeContent); err != nil {
+			log.Warnf("failed to embed %d: %v", id, err)
+		}
+	}
+	return id, nil
 }
 
-func (db *DB) evictID(url string) (int64, bool, error) {
-	var id int64
-	rows, err := db.Query(`SELECT id FROM web_data WHERE url = ? ORDER BY id DESC LIMIT 5`, url)
+// insert adds the page to web_data, and to the search index if it is
+// contentless.
+func (db *DB) insert(col DataColumn) (int64, error) {
+	// Prepared before the transaction takes the writer's only connection.
+	stmt, err := db.stmt(db.DB, `INSERT INTO web_data(url, scraped_at, title, content, digest) VALUES (?, ?, ?, ?, ?) RETURNING id`)
 	if err != nil {
-		return id, false, fmt.Errorf("failed to query old ids: %v", err)
+		return 0, err
 	}
-	defer rows.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
-	total := 0
-	for rows.Next() {
-		if err := rows.Scan(&id); err != nil {
-			return id, false, fmt.Errorf("failed to scan col: %v", err)
-		}
-		total++
+	title, content := db.seal("title", col.SafeTitle), db.seal("content", col.SafeContent)
+	digest := db.digest(col.URL, col.SafeTitle, col.SafeContent)
+	// A copy in the trash would keep the page from being saved again.
+	if _, err := tx.Exec(`
+	DELETE FROM web_data
+	WHERE deleted_at IS NOT NULL AND url = ? AND (digest = ? OR (title = ? AND content = ?))`,
+		col.URL, digest, title, content,
+	); err != nil {
+		return 0, fmt.Errorf("failed to purge a copy from the trash: %w", err)
 	}
-	if total < 5 {
-		return id, false, nil
+	res, err := tx.Stmt(stmt).Exec(col.URL, col.ScrapedAt.Format(ISO8601TZ), title, content, digest)
+	if err != nil {
+		return 0, err
 	}
-
-	return id, true, nil
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if db.contentless {
+		if _, err := tx.Exec(`INSERT INTO search_index(rowid, content, title) VALUES (?, ?, ?)`, id, col.SafeContent, col.SafeTitle); err != nil {
+			return 0, fmt.Errorf("failed to index: %w", err)
+		}
+	}
+	return id, tx.Commit()
 }
 
+// Evict drops the oldest versions of the URL beyond what its version rule
+// keeps, see VersionRule.
 func (db *DB) Evict(url string) error {
-	id, ok, err := db.evictID(url)
-	if err != nil || !ok {
+	rules, err := db.VersionRules()
+	if err != nil {
 		return err
 	}
+	_, err = db.evict(url, keepVersions(rules, url))
+	return err
+}
 
-	log.Infof("Dropping %q items below id %d", url, id)
-
-	result, deleteErr := db.Exec(`DELETE FROM web_data WHERE url = ? AND id < ?`, url, id)
-	if affected, err := result.RowsAffected(); err == nil {
+// evict drops all but the newest keep versions of the URL, not counting pinned
+// versions, and returns how many it dropped. Zero keeps every version.
+func (db *DB) evict(url string, keep int) (int64, error) {
+	if keep <= 0 {
+		return 0, nil
+	}
+	result, err := db.Exec(`
+	DELETE FROM web_data
+	WHERE url = ? AND NOT pinned AND `+notTrashed+` AND id NOT IN (
+		SELECT id FROM web_data WHERE url = ? AND NOT pinned AND `+notTrashed+` ORDER BY id DESC LIMIT ?
+	)`, url, url, keep)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err == nil && affected > 0 {
 		log.Infof("Dropped %d rows for %q", affected, url)
+		db.countEvictions("versions", affected)
 	}
-	if deleteErr != nil {
-		return fmt.Errorf("failed to delete: %v", deleteErr)
+	return affected, nil
+}
+
+// SearchQuery is a full text query and the filters that narrow it down.
+type SearchQuery struct {
+	Query string
+	// Site limits results to pages from one host.
+	Site string
+	// Month limits results to pages scraped in one month, formatted as
+	// 2006-01.
+	Month string
+	// Mode is how results are ranked, either KeywordSearch or HybridSearch.
+	Mode string
+	// Cursor is where the page starts, the zero cursor being the first page.
+	Cursor Cursor
+	// Limit is the page size, see pageSize.
+	Limit int
+	// WithFacets asks for the facet counts of all matches, not just the
+	// current page.
+	WithFacets bool
+}
+
+// SearchPage is one page of search results.
+type SearchPage struct {
+	Results []SearchResult
+	// Next and Prev point at the neighbouring pages, if there are any.
+	Next, Prev *Cursor
+	// Total is the number of results across all pages. If Estimated is set,
+	// there may be more.
+	Total     int
+	Estimated bool
+	// Facets is only set when it was asked for.
+	Facets *Facets
+}
+
+// hostExpr extracts the host from web_data.url. URLs are always saved with a
+// scheme, see scrapePage.
+const hostExpr = `substr(url, instr(url, '://') + 3, instr(substr(url, instr(url, '://') + 3) || '/', '/') - 1)`
+
+// monthExpr extracts the month from web_data.scraped_at.
+const monthExpr = `substr(scraped_at, 1, 7)`
+
+const (
+	// KeywordSearch ranks results by bm25 alone.
+	KeywordSearch = "keyword"
+	// HybridSearch fuses the bm25 ranking with a ranking by similarity to the
+	// query's embedding, so that pages using different words still match.
+	HybridSearch = "hybrid"
+)
+
+// where builds the conditions shared by the search and facet queries.
+func (q SearchQuery) where() (string, []any) {
+	clause, args := q.filters()
+	return `search_index MATCH ?` + clause, append([]any{q.Query}, args...)
+}
+
+// filters builds the conditions narrowing down a search, apart from the full
+// text match itself. The clause starts with AND, and always leaves out pages in
+// the trash.
+func (q SearchQuery) filters() (string, []any) {
+	clause := ` AND ` + notTrashed
+	var args []any
+	if q.Site != "" {
+		clause += ` AND ` + hostExpr + ` = ?`
+		args = append(args, q.Site)
 	}
-	return nil
+	if q.Month != "" {
+		clause += ` AND ` + monthExpr + ` = ?`
+		args = append(args, q.Month)
+	}
+	return clause, args
 }
 
-func (db *DB) Search(query string, page int) ([]SearchResult, error) {
-	rows, err := db.Query(`
-	SELECT
-		id, url, scraped_at, search_index.title, search_index.content,
-		snippet(search_index, 0, '<b>', '</b>', '...', 40)
+func (db *DB) Search(q SearchQuery) (SearchPage, error) {
+	var page SearchPage
+	var err error
+	if q.Mode == HybridSearch && db.Embedder != nil {
+		page, err = db.hybridSearch(q)
+	} else {
+		page, err = db.keywordSearch(q)
+	}
+	if err != nil {
+		return SearchPage{}, err
+	}
+
+	if q.WithFacets {
+		facets, err := db.facets(q)
+		if err != nil {
+			return SearchPage{}, fmt.Errorf("facets: %w", err)
+		}
+		page.Facets = &facets
+	}
+	return page, nil
+}
+
+func (db *DB) keywordSearch(q SearchQuery) (SearchPage, error) {
+	where, args := q.where()
+	limit := pageSize(q.Limit)
+	keyset, order := `true`, `score, id`
+	var keyArgs []any
+	switch {
+	case q.Cursor.Before:
+		keyset, order = `score < ? OR (score = ? AND id < ?)`, `score DESC, id DESC`
+		keyArgs = []any{q.Cursor.Rank, q.Cursor.Rank, q.Cursor.ID}
+	case !q.Cursor.IsZero():
+		keyset = `score > ? OR (score = ? AND id > ?)`
+		keyArgs = []any{q.Cursor.Rank, q.Cursor.Rank, q.Cursor.ID}
+	}
+
+	// Only rank the matches here. Snippets are expensive and only needed for
+	// the rows on this page.
+	rows, err := db.read.Query(`
+	SELECT id, score FROM (
+		SELECT id, bm25(search_index, ?, ?) AS score
+		FROM web_data
+		INNER JOIN search_index ON web_data.id = search_index.rowid
+		WHERE `+where+`
+	)
+	WHERE `+keyset+`
+	ORDER BY `+order+`
+	LIMIT ?`,
+		slices.Concat([]any{db.Weights.Content, db.Weights.Title}, args, keyArgs, []any{limit + 1})...,
+	)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	defer rows.Close()
+
+	var ranked []Cursor
+	for rows.Next() {
+		var c Cursor
+		if err := rows.Scan(&c.ID, &c.Rank); err != nil {
+			return SearchPage{}, fmt.Errorf("column %d: scan: %w", len(ranked), err)
+		}
+		ranked = append(ranked, c)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchPage{}, err
+	}
+
+	var page SearchPage
+	ranked, page.Next, page.Prev = keysetPage(ranked, limit, q.Cursor, func(c Cursor) Cursor { return c })
+	ids := make([]int64, len(ranked))
+	for i, c := range ranked {
+		ids[i] = c.ID
+	}
+	page.Results, err = db.resultsByID(q.Query, ids)
+	if err != nil {
+		return SearchPage{}, err
+	}
+
+	err = db.read.QueryRow(`
+	SELECT count(*)
 	FROM web_data
 	INNER JOIN search_index ON web_data.id = search_index.rowid
-	WHERE search_index MATCH ?
-	ORDER BY rank
-	LIMIT 50 OFFSET ?`,
-		query, page*50,
-	)
+	WHERE `+where, args...).Scan(&page.Total)
+	if err != nil {
+		return SearchPage{}, fmt.Errorf("count: %w", err)
+	}
+	return page, nil
+}
+
+// resultsByID loads search results in the given order. Pages that matched the
+// full text query get a snippet, the rest start with the top of the page.
+func (db *DB) resultsByID(query string, ids []int64) ([]SearchResult, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	in, args := inList(ids)
+
+	blurbs, err := db.snippets(query, in, args)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.read.Query(`SELECT id, url, scraped_at, title, content FROM web_data WHERE id IN `+in, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	now := time.Now()
-	var results []SearchResult
+	terms := queryTerms(query)
+	byID := make(map[int64]SearchResult)
 	for rows.Next() {
 		var r SearchResult
 		var scrapeTime string
-		if err := rows.Scan(&r.ID, &r.URL, &scrapeTime, &r.SafeTitle, &r.SafeContent, &r.SafeBlurb); err != nil {
-			return nil, fmt.Errorf("column %d: scan: %w", len(results), err)
+		if err := rows.Scan(&r.ID, &r.URL, &scrapeTime, db.opened("title", &r.SafeTitle), db.opened("content", &r.SafeContent)); err != nil {
+			return nil, fmt.Errorf("column %d: scan: %w", len(byID), err)
 		}
 		t, err := timeFromDB(scrapeTime)
 		if err != nil {
-			return nil, fmt.Errorf("column %d: %w", len(results), err)
+			return nil, fmt.Errorf("column %d: %w", len(byID), err)
 		}
 		r.ScrapedAt = t
 		r.ScrapedAgo = prettytime.DurationBetween(now, t)
-		results = append(results, r)
+		blurb, ok := blurbs[r.ID]
+		if !ok && db.contentless {
+			blurb, ok = termSnippet(r.DataColumn, terms, 40)
+		}
+		if !ok {
+			blurb = leadingWords(r.SafeContent, 40)
+		}
+		r.SafeBlurb = blurb
+		byID[int64(r.ID)] = r
 	}
-
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+
+	results := make([]SearchResult, 0, len(ids))
+	for _, id := range ids {
+		if r, ok := byID[id]; ok {
+			results = append(results, r)
+		}
+	}
 	return results, nil
 }
 
+// snippets makes a snippet of each page in the IN list that matched the full
+// text query. A contentless index can't, see termSnippet.
+func (db *DB) snippets(query, in string, args []any) (map[int]template.HTML, error) {
+	blurbs := make(map[int]template.HTML)
+	if db.contentless {
+		return blurbs, nil
+	}
+	rows, err := db.read.Query(`
+	SELECT
+		rowid,
+		snippet(search_index, 0, '<b>', '</b>', '...', 40),
+		snippet(search_index, 1, '<b>', '</b>', '...', 40)
+	FROM search_index
+	WHERE search_index MATCH ? AND rowid IN `+in,
+		append([]any{query}, args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var blurb, titleBlurb template.HTML
+		if err := rows.Scan(&id, &blurb, &titleBlurb); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan snippet: %w", err)
+		}
+		// If only the title matched, the content snippet is just the start of
+		// the page. Show where the title matched instead.
+		if !strings.Contains(string(blurb), "<b>") {
+			blurb = titleBlurb
+		}
+		blurbs[id] = blurb
+	}
+	rows.Close()
+	return blurbs, rows.Err()
+}
+
+// leadingWords shortens already escaped content to its first n words.
+func leadingWords(safe template.HTML, n int) template.HTML {
+	words := strings.Fields(string(safe))
+	if len(words) <= n {
+		return template.HTML(strings.Join(words, " "))
+	}
+	return template.HTML(strings.Join(words[:n], " ") + "...")
+}
+
+// inList formats values as a parenthesized list of placeholders for an IN
+// clause.
+func inList[T any](values []T) (string, []any) {
+	args := make([]any, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return "(" + strings.TrimSuffix(strings.Repeat("?,", len(values)), ",") + ")", args
+}
+
 func (db *DB) Fetch(id int64) (SearchResult, error) {
-	rows, err := db.Query(`
+	stmt, err := db.stmt(db.read, `
 	SELECT
-		url, scraped_at, title, content
+		url, scraped_at, title, content, pinned
 	FROM web_data
-	WHERE id = ?`,
-		id,
-	)
+	WHERE id = ? AND `+notTrashed)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	rows, err := stmt.Query(id)
 	if err != nil {
 		return SearchResult{}, err
 	}
 	defer rows.Close()
 
 	now := time.Now()
-	rows.Next()
-	var r SearchResult
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return SearchResult{}, err
+		}
+		return SearchResult{}, ErrNotFound
+	}
+	r := SearchResult{ID: int(id)}
 	var scrapeTime string
-	if err := rows.Scan(&r.URL, &scrapeTime, &r.SafeTitle, &r.SafeContent); err != nil {
+	if err := rows.Scan(&r.URL, &scrapeTime, db.opened("title", &r.SafeTitle), db.opened("content", &r.SafeContent), &r.Pinned); err != nil {
 		return r, fmt.Errorf("scan: %w", err)
 	}
 	t, err := timeFromDB(scrapeTime)
@@ -208,25 +617,39 @@ func timeFromDB(tstring string) (time.Time, error) {
 	return t.Local(), nil
 }
 
+// Delete moves the page to the trash, see Trash.
 func (db *DB) Delete(id int64) error {
-	_, err := db.Exec(`DELETE FROM web_data WHERE id = ?`, id)
+	_, err := db.Exec(`UPDATE web_data SET deleted_at = ? WHERE id = ? AND `+notTrashed, time.Now().Format(ISO8601TZ), id)
 	if err != nil {
 		return fmt.Errorf("failed to delete: %v", err)
 	}
 	return nil
 }
 
-func (db *DB) History(page int) ([]SearchResult, error) {
-	rows, err := db.Query(`
+func (db *DB) History(from Cursor, limit int) (SearchPage, error) {
+	limit = pageSize(limit)
+	keyset, order := `true`, `id DESC`
+	var keyArgs []any
+	switch {
+	case from.Before:
+		keyset, order = `id > ?`, `id`
+		keyArgs = []any{from.ID}
+	case !from.IsZero():
+		keyset = `id < ?`
+		keyArgs = []any{from.ID}
+	}
+
+	rows, err := db.read.Query(`
 	SELECT
 		id, url, scraped_at, title, content
 	FROM web_data
-	ORDER BY id DESC
-	LIMIT 50 OFFSET ?`,
-		page*50,
+	WHERE (`+keyset+`) AND `+notTrashed+`
+	ORDER BY `+order+`
+	LIMIT ?`,
+		append(keyArgs, limit+1)...,
 	)
 	if err != nil {
-		return nil, err
+		return SearchPage{}, err
 	}
 	defer rows.Close()
 
@@ -235,20 +658,31 @@ func (db *DB) History(page int) ([]SearchResult, error) {
 	for rows.Next() {
 		var r SearchResult
 		var scrapeTime string
-		if err := rows.Scan(&r.ID, &r.URL, &scrapeTime, &r.SafeTitle, &r.SafeContent); err != nil {
-			return nil, fmt.Errorf("column %d: scan: %w", len(results), err)
+		if err := rows.Scan(&r.ID, &r.URL, &scrapeTime, db.opened("title", &r.SafeTitle), db.opened("content", &r.SafeContent)); err != nil {
+			return SearchPage{}, fmt.Errorf("column %d: scan: %w", len(results), err)
 		}
 		t, err := timeFromDB(scrapeTime)
 		if err != nil {
-			return nil, fmt.Errorf("column %d: %w", len(results), err)
+			return SearchPage{}, fmt.Errorf("column %d: %w", len(results), err)
 		}
 		r.ScrapedAt = t
 		r.ScrapedAgo = prettytime.DurationBetween(now, t)
 		results = append(results, r)
 	}
-
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return SearchPage{}, err
 	}
-	return results, nil
+
+	var page SearchPage
+	page.Results, page.Next, page.Prev = keysetPage(results, limit, from, func(r SearchResult) Cursor {
+		return Cursor{ID: int64(r.ID)}
+	})
+	count, err := db.stmt(db.read, `SELECT count(*) FROM web_data WHERE `+notTrashed)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	if err := count.QueryRow().Scan(&page.Total); err != nil {
+		return SearchPage{}, fmt.Errorf("count: %w", err)
+	}
+	return page, nil
 }
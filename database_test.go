@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentSaveSearch saves and searches from several goroutines at once,
+// which should neither fail with SQLITE_BUSY nor deadlock on the single writer
+// connection.
+func TestConcurrentSaveSearch(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	const workers, pages = 8, 25
+	errs := make(chan error, 2*workers*pages)
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range pages {
+				page := testPage(fmt.Sprintf("https://%d.com/%d", w, i), "page", fmt.Sprintf("busy worker %d page %d", w, i))
+				id, err := db.Save(page)
+				if err != nil {
+					errs <- fmt.Errorf("Save: %w", err)
+					continue
+				}
+				if err := db.SetPinned(id, i%2 == 0); err != nil {
+					errs <- fmt.Errorf("SetPinned: %w", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range pages {
+				if _, err := db.Search(SearchQuery{Query: "busy", WithFacets: true}); err != nil {
+					errs <- fmt.Errorf("Search: %w", err)
+				}
+				if _, err := db.History(Cursor{}, 10); err != nil {
+					errs <- fmt.Errorf("History: %w", err)
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("saving and searching deadlocked")
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	page, err := db.Search(SearchQuery{Query: "busy"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if page.Total != workers*pages {
+		t.Errorf("found %d pages, wanted %d", page.Total, workers*pages)
+	}
+}
+
+// TestFetchReadPool checks that pages are read through the read-only pool,
+// which sees what the writer committed.
+func TestFetchReadPool(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.read.Close()
+	id := mustSave(t, db, testPage("https://a.com/", "Owls", "owls are birds"))
+
+	// With the writer closed, only the read pool is left to fetch with.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	page, err := db.Fetch(id)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if page.URL != "https://a.com/" || page.SafeContent != "owls are birds" {
+		t.Errorf("Fetch = %+v", page)
+	}
+	if _, err := db.read.Exec(`DELETE FROM web_data`); err == nil {
+		t.Errorf("the read pool can write")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/auth"
+	"github.com/spencer-p/palace/pkg/keyring"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// contentKeys encrypt page titles and content at rest, or are nil to store
+// them in the clear. See DB.Keys.
+var contentKeys = contentKeysFromEnv()
+
+// contentKeysFromEnv reads the key pages are sealed with from CONTENT_KEY, and
+// keys they may have been sealed with before from CONTENT_OLD_KEYS. With only
+// old keys, pages are decrypted.
+func contentKeysFromEnv() *keyring.Keyring {
+	current, old := os.Getenv("CONTENT_KEY"), os.Getenv("CONTENT_OLD_KEYS")
+	if current == "" && old == "" {
+		return nil
+	}
+	var currentKey []byte
+	if current != "" {
+		currentKey = auth.MustDecodeBase64([]byte(current))
+	}
+	var oldKeys [][]byte
+	for _, key := range strings.Split(old, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			oldKeys = append(oldKeys, auth.MustDecodeBase64([]byte(key)))
+		}
+	}
+	keys, err := keyring.New(currentKey, oldKeys...)
+	if err != nil {
+		// Better not to start than to store pages in the clear.
+		log.Fatalf("CONTENT_KEY: %v", err)
+	}
+	return keys
+}
+
+// sealing reports whether new pages are encrypted.
+func (db *DB) sealing() bool {
+	return db.Keys != nil && db.Keys.Sealing()
+}
+
+// seal returns what to store in a title or content column: the escaped text
+// itself, or the text sealed under the current key. The column name is
+// authenticated with it, so a title can't be passed off as content.
+func (db *DB) seal(column string, safe template.HTML) any {
+	if !db.sealing() {
+		return string(safe)
+	}
+	return db.Keys.Seal([]byte(safe), []byte(column))
+}
+
+// digest identifies a page for web_data_digest, or is nil if pages are stored
+// in the clear and web_data_uniq does the job.
+func (db *DB) digest(url string, safeTitle, safeContent template.HTML) any {
+	if !db.sealing() {
+		return nil
+	}
+	return db.Keys.Digest([]byte(url), []byte(safeTitle), []byte(safeContent))
+}
+
+// opened scans a title or content column into dst, decrypting it if it was
+// sealed.
+func (db *DB) opened(column string, dst *template.HTML) sql.Scanner {
+	return openedColumn{keys: db.Keys, column: column, dst: dst}
+}
+
+type openedColumn struct {
+	keys   *keyring.Keyring
+	column string
+	dst    *template.HTML
+}
+
+func (c openedColumn) Scan(value any) error {
+	switch v := value.(type) {
+	case string:
+		*c.dst = template.HTML(v)
+	case []byte:
+		// Sealed values are the only blobs.
+		if c.keys == nil {
+			return fmt.Errorf("%s is encrypted but CONTENT_KEY is not set", c.column)
+		}
+		plain, err := c.keys.Open(v, []byte(c.column))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", c.column, err)
+		}
+		*c.dst = template.HTML(plain)
+	default:
+		return fmt.Errorf("unexpected %T in %s", value, c.column)
+	}
+	return nil
+}
+
+// The search index comes in two shapes. In the clear, it reads titles and
+// content from web_data, which keeps snippets and highlights exact. Once pages
+// are encrypted it can't, so it is contentless: it keeps only the words of
+// each page, Save fills it in, and snippets are approximated in Go.
+const (
+	externalIndex = `
+	DROP TRIGGER IF EXISTS wd_ad;
+	DROP TABLE search_index;
+	CREATE VIRTUAL TABLE search_index USING fts5
+		( content = 'web_data'
+		, content_rowid = 'id'
+		, tokenize = 'porter unicode61'
+		, prefix = '2 3'
+		, content
+		, title
+	);
+	CREATE TRIGGER wd_ai AFTER INSERT ON web_data BEGIN
+		INSERT INTO search_index(rowid, content, title) VALUES (new.id, new.content, new.title);
+	END;
+	CREATE TRIGGER wd_ad AFTER DELETE ON web_data BEGIN
+		INSERT INTO search_index(search_index, rowid, content, title) VALUES('delete', old.id, old.content, old.title);
+	END;
+	INSERT INTO search_index(search_index) VALUES ('rebuild');`
+
+	contentlessIndex = `
+	DROP TRIGGER IF EXISTS wd_ai;
+	DROP TRIGGER IF EXISTS wd_ad;
+	DROP TABLE search_index;
+	CREATE VIRTUAL TABLE search_index USING fts5
+		( content = ''
+		, contentless_delete = 1
+		, tokenize = 'porter unicode61'
+		, prefix = '2 3'
+		, content
+		, title
+	);
+	CREATE TRIGGER wd_ad AFTER DELETE ON web_data BEGIN
+		DELETE FROM search_index WHERE rowid = old.id;
+	END;`
+)
+
+// indexIsContentless reports which shape the search index has.
+func (db *DB) indexIsContentless() (bool, error) {
+	var schema string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE name = 'search_index'`).Scan(&schema); err != nil {
+		return false, fmt.Errorf("failed to read search index schema: %w", err)
+	}
+	return strings.Contains(schema, "contentless_delete"), nil
+}
+
+// setContentless rebuilds the search index in the other shape.
+func (db *DB) setContentless(contentless bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	schema := externalIndex
+	if contentless {
+		schema = contentlessIndex
+	}
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+	if contentless {
+		if err := db.fillIndex(tx); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.contentless = contentless
+	return nil
+}
+
+// fillIndex adds every page to the empty contentless index. FTS5 can't rebuild
+// it from web_data, which may be encrypted.
+func (db *DB) fillIndex(tx *sql.Tx) error {
+	var last int64
+	for {
+		rows, err := tx.Query(`SELECT id, title, content FROM web_data WHERE id > ? ORDER BY id LIMIT 100`, last)
+		if err != nil {
+			return err
+		}
+		type page struct {
+			id             int64
+			title, content template.HTML
+		}
+		var batch []page
+		for rows.Next() {
+			var p page
+			if err := rows.Scan(&p.id, db.opened("title", &p.title), db.opened("content", &p.content)); err != nil {
+				rows.Close()
+				return fmt.Errorf("scan: %w", err)
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, p := range batch {
+			if _, err := tx.Exec(`INSERT INTO search_index(rowid, content, title) VALUES (?, ?, ?)`, p.id, p.content, p.title); err != nil {
+				return fmt.Errorf("index page %d: %w", p.id, err)
+			}
+		}
+		last = batch[len(batch)-1].id
+	}
+}
+
+// reindex empties the contentless index and fills it again.
+func (db *DB) reindex() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO search_index(search_index) VALUES ('delete-all')`); err != nil {
+		return err
+	}
+	if err := db.fillIndex(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ApplyKeys brings the database in line with db.Keys. Before anything is
+// encrypted the index is made contentless, then every title and content not
+// sealed under the current key is sealed again, or decrypted if there is no
+// current key. Once nothing is encrypted, the index reads from web_data again.
+func (db *DB) ApplyKeys() error {
+	if db.Keys == nil && !db.contentless {
+		// Nothing was ever encrypted.
+		return nil
+	}
+	if db.sealing() && !db.contentless {
+		log.Infof("Rebuilding the search index for encrypted pages")
+		if err := db.setContentless(true); err != nil {
+			return fmt.Errorf("failed to make the search index contentless: %w", err)
+		}
+	}
+
+	pages, err := db.resealPages()
+	if pages > 0 {
+		log.Infof("Re-encrypted %d pages", pages)
+	}
+	if err != nil {
+		return err
+	}
+	alerts, err := db.resealAlerts()
+	if alerts > 0 {
+		log.Infof("Re-encrypted the titles of %d alerts", alerts)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !db.sealing() && db.contentless {
+		log.Infof("Rebuilding the search index for pages in the clear")
+		if err := db.setContentless(false); err != nil {
+			return fmt.Errorf("failed to rebuild the search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// stale selects the rows of a title or content column that aren't as ApplyKeys
+// wants them.
+func (db *DB) stale(column string) (string, []any) {
+	if !db.sealing() {
+		return `typeof(` + column + `) = 'blob'`, nil
+	}
+	// After the version byte, sealed values start with their key's ID.
+	return `typeof(` + column + `) = 'text' OR substr(` + column + `, 2, 4) != ?`, []any{db.Keys.CurrentID()}
+}
+
+// resealPages seals the pages that aren't under the current key, and returns
+// how many it changed.
+func (db *DB) resealPages() (int, error) {
+	where, args := db.stale("content")
+	total := 0
+	for {
+		rows, err := db.Query(`SELECT id, url, title, content FROM web_data WHERE `+where+` LIMIT 100`, args...)
+		if err != nil {
+			return total, err
+		}
+		type page struct {
+			id             int64
+			url            string
+			title, content template.HTML
+		}
+		var batch []page
+		for rows.Next() {
+			var p page
+			if err := rows.Scan(&p.id, &p.url, db.opened("title", &p.title), db.opened("content", &p.content)); err != nil {
+				rows.Close()
+				return total, fmt.Errorf("page %d: %w", p.id, err)
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		for _, p := range batch {
+			_, err := db.Exec(`UPDATE web_data SET title = ?, content = ?, digest = ? WHERE id = ?`,
+				db.seal("title", p.title), db.seal("content", p.content), db.digest(p.url, p.title, p.content), p.id)
+			if isUniqueViolation(err) {
+				// A copy saved under a different key, which couldn't be
+				// recognized as one until now.
+				log.Infof("Dropping page %d, a copy of another page", p.id)
+				_, err = db.Exec(`DELETE FROM web_data WHERE id = ?`, p.id)
+			}
+			if err != nil {
+				return total, fmt.Errorf("page %d: %w", p.id, err)
+			}
+		}
+		total += len(batch)
+	}
+}
+
+// resealAlerts does the same as resealPages for the titles kept with alerts.
+func (db *DB) resealAlerts() (int, error) {
+	where, args := db.stale("title")
+	rows, err := db.Query(`SELECT id, title FROM search_alerts WHERE `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	titles := make(map[int64]template.HTML)
+	for rows.Next() {
+		var id int64
+		var title template.HTML
+		if err := rows.Scan(&id, db.opened("title", &title)); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("alert %d: %w", id, err)
+		}
+		titles[id] = title
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for id, title := range titles {
+		if _, err := db.Exec(`UPDATE search_alerts SET title = ? WHERE id = ?`, db.seal("title", title), id); err != nil {
+			return 0, fmt.Errorf("alert %d: %w", id, err)
+		}
+	}
+	return len(titles), nil
+}
+
+func isUniqueViolation(err error) bool {
+	sqliteErr := &sqlite.Error{}
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
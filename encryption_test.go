@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spencer-p/palace/pkg/keyring"
+)
+
+func testKey(n byte) []byte {
+	return bytes.Repeat([]byte{n}, 32)
+}
+
+// newEncryptedDB opens the database at path with keys made from current and
+// old, applying them as the server does on startup.
+func newEncryptedDB(t *testing.T, path string, current []byte, old ...[]byte) *DB {
+	t.Helper()
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if current != nil || len(old) > 0 {
+		if db.Keys, err = keyring.New(current, old...); err != nil {
+			t.Fatalf("keyring.New: %v", err)
+		}
+	}
+	if err := db.ApplyKeys(); err != nil {
+		t.Fatalf("ApplyKeys: %v", err)
+	}
+	return db
+}
+
+func TestEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "palace.db")
+	db := newEncryptedDB(t, path, nil)
+	plainID := mustSave(t, db, testPage("https://a.com/", "Aardvarks", "an aardvark digs for termites"))
+
+	// searchable checks that the pages can be found and read, and that their
+	// text is or isn't on disk.
+	searchable := func(t *testing.T, db *DB, wantOnDisk bool) {
+		t.Helper()
+		page, err := db.Search(SearchQuery{Query: "termites"})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(page.Results) != 1 || page.Results[0].SafeTitle != "Aardvarks" {
+			t.Fatalf("Search returned %+v", page.Results)
+		}
+		if blurb := string(page.Results[0].SafeBlurb); !strings.Contains(blurb, "<b>termites</b>") {
+			t.Errorf("snippet %q doesn't mark the match", blurb)
+		}
+		if _, n, err := db.Highlight(plainID, "termites"); err != nil || n != 1 {
+			t.Errorf("Highlight found %d matches: %v", n, err)
+		}
+		if _, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if onDisk := bytes.Contains(file, []byte("digs for termites")); onDisk != wantOnDisk {
+			t.Errorf("content on disk is %t, wanted %t", onDisk, wantOnDisk)
+		}
+	}
+
+	t.Run("in the clear", func(t *testing.T) {
+		searchable(t, db, true)
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		db.Close()
+		db = newEncryptedDB(t, path, testKey(1))
+		if !db.contentless {
+			t.Fatalf("index is not contentless")
+		}
+		searchable(t, db, false)
+		mustSave(t, db, testPage("https://b.com/", "Badgers", "a badger digs a sett"))
+		if _, err := db.Save(testPage("https://b.com/", "Badgers", "a badger digs a sett")); err == nil {
+			t.Errorf("saved the same page twice")
+		}
+	})
+
+	t.Run("rotated", func(t *testing.T) {
+		db.Close()
+		db = newEncryptedDB(t, path, testKey(2), testKey(1))
+		searchable(t, db, false)
+		var stale int
+		if err := db.QueryRow(`SELECT count(*) FROM web_data WHERE substr(content, 2, 4) != ?`, db.Keys.CurrentID()).Scan(&stale); err != nil || stale != 0 {
+			t.Errorf("%d pages are still under the old key: %v", stale, err)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		db.Close()
+		db, err := NewDB(path)
+		if err != nil {
+			t.Fatalf("NewDB: %v", err)
+		}
+		defer db.Close()
+		if err := db.ApplyKeys(); err == nil || !strings.Contains(err.Error(), "CONTENT_KEY") {
+			t.Errorf("ApplyKeys without keys returned %v", err)
+		}
+		if _, err := db.Fetch(plainID); err == nil {
+			t.Errorf("Fetch without keys succeeded")
+		}
+	})
+
+	t.Run("decrypted", func(t *testing.T) {
+		db = newEncryptedDB(t, path, nil, testKey(2))
+		if db.contentless {
+			t.Fatalf("index is still contentless")
+		}
+		searchable(t, db, true)
+		page, err := db.Search(SearchQuery{Query: "sett"})
+		if err != nil || len(page.Results) != 1 {
+			t.Errorf("Search for the page saved encrypted returned %v: %v", page.Results, err)
+		}
+	})
+}
+
+func TestTermSnippet(t *testing.T) {
+	words := make([]string, 60)
+	for i := range words {
+		words[i] = fmt.Sprint("w", i)
+	}
+	long := strings.Join(words, " ")
+
+	table := []struct {
+		query   string
+		col     DataColumn
+		want    string
+		wantHit bool
+	}{{
+		query:   "cats",
+		col:     testPage("", "Pets", "my cat is small & furry"),
+		want:    "my <b>cat</b> is small &amp; furry",
+		wantHit: true,
+	}, {
+		query:   `title : (jerry *) AND "tom"`,
+		col:     testPage("", "Tom & Jerry", "cartoons"),
+		want:    "<b>Tom</b> &amp; <b>Jerry</b>",
+		wantHit: true,
+	}, {
+		query:   "w30",
+		col:     testPage("", "Long", long),
+		want:    "...w20 w21 w22 w23 w24 w25 w26 w27 w28 w29 <b>w30</b> w31",
+		wantHit: true,
+	}, {
+		query: "dogs NOT cats",
+		col:   testPage("", "Birds", "birds sing"),
+	}}
+	for _, tc := range table {
+		t.Run(tc.query, func(t *testing.T) {
+			got, ok := termSnippet(tc.col, queryTerms(tc.query), 40)
+			if ok != tc.wantHit || !strings.HasPrefix(string(got), tc.want) {
+				t.Errorf("termSnippet returned %q, %t, wanted it to start with %q, %t", got, ok, tc.want, tc.wantHit)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// exportBatch is how many pages are loaded at a time when exporting a ranking
+// that was computed in memory.
+const exportBatch = 500
+
+// Export calls yield with every match of q, best first, instead of a page at a
+// time. Only the best ranked copy of each URL is kept. The content of the results
+// is not loaded.
+func (db *DB) Export(q SearchQuery, yield func(SearchResult) error) error {
+	seen := make(map[string]bool)
+	dedup := func(r SearchResult) error {
+		if seen[r.URL] {
+			return nil
+		}
+		seen[r.URL] = true
+		return yield(r)
+	}
+	if q.Mode == HybridSearch && db.Embedder != nil {
+		return db.exportHybrid(q, dedup)
+	}
+	return db.exportKeyword(q, dedup)
+}
+
+func (db *DB) exportKeyword(q SearchQuery, yield func(SearchResult) error) error {
+	where, args := q.where()
+	rows, err := db.read.Query(`
+	SELECT id, url, scraped_at, web_data.title
+	FROM web_data
+	INNER JOIN search_index ON web_data.id = search_index.rowid
+	WHERE `+where+`
+	ORDER BY bm25(search_index, ?, ?), id DESC`,
+		append(args, db.Weights.Content, db.Weights.Title)...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return db.scanExport(rows, yield)
+}
+
+func (db *DB) exportHybrid(q SearchQuery, yield func(SearchResult) error) error {
+	ids, _, err := db.hybridIDs(q, -1)
+	if err != nil {
+		return err
+	}
+	for len(ids) > 0 {
+		batch := ids[:min(exportBatch, len(ids))]
+		ids = ids[len(batch):]
+		in, args := inList(batch)
+		rows, err := db.read.Query(`SELECT id, url, scraped_at, title FROM web_data WHERE id IN `+in, args...)
+		if err != nil {
+			return err
+		}
+		byID := make(map[int]SearchResult)
+		err = db.scanExport(rows, func(r SearchResult) error {
+			byID[r.ID] = r
+			return nil
+		})
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		for _, id := range batch {
+			if r, ok := byID[int(id)]; ok {
+				if err := yield(r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// scanExport reads rows of id, url, scraped_at and title.
+func (db *DB) scanExport(rows *sql.Rows, yield func(SearchResult) error) error {
+	for rows.Next() {
+		var r SearchResult
+		var scrapeTime string
+		if err := rows.Scan(&r.ID, &r.URL, &scrapeTime, db.opened("title", &r.SafeTitle)); err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+		t, err := timeFromDB(scrapeTime)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", r.ID, err)
+		}
+		r.ScrapedAt = t
+		if err := yield(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportWriter writes search results in one export format.
+type exportWriter interface {
+	Write(r SearchResult) error
+	// Flush writes anything still buffered.
+	Flush() error
+}
+
+type exportFormat struct {
+	ContentType string
+	Extension   string
+	New         func(w io.Writer) exportWriter
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv":      {"text/csv", "csv", newCSVExport},
+	"jsonl":    {"application/jsonl", "jsonl", newJSONLExport},
+	"markdown": {"text/markdown", "md", newMarkdownExport},
+}
+
+type csvExport struct {
+	w *csv.Writer
+}
+
+func newCSVExport(w io.Writer) exportWriter {
+	e := csvExport{csv.NewWriter(w)}
+	e.w.Write([]string{"id", "url", "title", "scraped_at"})
+	return e
+}
+
+func (e csvExport) Write(r SearchResult) error {
+	return e.w.Write([]string{
+		fmt.Sprint(r.ID),
+		r.URL,
+		html.UnescapeString(string(r.SafeTitle)),
+		r.ScrapedAt.Format(time.RFC3339),
+	})
+}
+
+func (e csvExport) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlExport struct {
+	enc *json.Encoder
+}
+
+func newJSONLExport(w io.Writer) exportWriter {
+	return jsonlExport{json.NewEncoder(w)}
+}
+
+// jsonlRecord is apiResult without the blurb, which exports don't have.
+type jsonlRecord struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Title     string    `json:"title"`
+	ScrapedAt time.Time `json:"scraped_at"`
+}
+
+func (e jsonlExport) Write(r SearchResult) error {
+	return e.enc.Encode(jsonlRecord{
+		ID:        r.ID,
+		URL:       r.URL,
+		Title:     html.UnescapeString(string(r.SafeTitle)),
+		ScrapedAt: r.ScrapedAt,
+	})
+}
+
+func (e jsonlExport) Flush() error { return nil }
+
+type markdownExport struct {
+	w io.Writer
+}
+
+func newMarkdownExport(w io.Writer) exportWriter {
+	return markdownExport{w}
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`, `*`, `\*`, `_`, `\_`, "`", "\\`")
+
+// Write adds a list item linking to the page. The URL is in angle brackets in
+// case it has spaces or parentheses.
+func (e markdownExport) Write(r SearchResult) error {
+	title := markdownEscaper.Replace(html.UnescapeString(string(r.SafeTitle)))
+	_, err := fmt.Fprintf(e.w, "- [%s](<%s>) (%s)\n", title, r.URL, r.ScrapedAt.Format(time.DateOnly))
+	return err
+}
+
+func (e markdownExport) Flush() error { return nil }
+
+// exportLink links to an export of the search on the page, in the given format.
+func exportLink(prefix string, in *url.URL, format string) string {
+	vals := in.Query()
+	vals.Del("cursor")
+	vals.Del("limit")
+	vals.Set("format", format)
+	u := url.URL{
+		Path:     filepath.Join(prefix, "/api/export"),
+		RawQuery: vals.Encode(),
+	}
+	return u.String()
+}
+
+// makeExport streams every match of a search as a download. The format is
+// picked by the form value "format", CSV by default.
+func makeExport(store Exporter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := searchFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Query == "" {
+			http.Error(w, "Missing query", http.StatusBadRequest)
+			return
+		}
+		name := r.FormValue("format")
+		if name == "" {
+			name = "csv"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown format %q", name), http.StatusBadRequest)
+			return
+		}
+
+		// Errors in the query only show up once it is run, so hold off on the
+		// headers until the first result.
+		var out exportWriter
+		start := func() {
+			w.Header().Set("Content-Type", format.ContentType+"; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="palace-export.%s"`, format.Extension))
+			w.WriteHeader(http.StatusOK)
+			out = format.New(w)
+		}
+		n := 0
+		err = store.Export(q, func(r SearchResult) error {
+			if out == nil {
+				start()
+			}
+			n++
+			return out.Write(r)
+		})
+		if err != nil && out == nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("export: failed to query for %q: %v", q.Query, err)
+			return
+		}
+		if out == nil {
+			start()
+		}
+		if flushErr := out.Flush(); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			log.Warnf("export: failed after %d results for %q: %v", n, q.Query, err)
+			return
+		}
+		log.Infof("Exported %d results for %q as %s", n, q.Query, name)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Facets break down all matches of a search to give an overview of where the
+// hits come from. Pages don't carry tags or a language, so there are no facets
+// for those.
+type Facets struct {
+	Sites  []FacetCount `json:"sites"`
+	Months []FacetCount `json:"months"`
+}
+
+// FacetCount is the number of matches sharing a value.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+const (
+	maxSiteFacets  = 10
+	maxMonthFacets = 12
+)
+
+func (db *DB) facets(q SearchQuery) (Facets, error) {
+	var f Facets
+	var err error
+	f.Sites, err = db.facetCounts(q, hostExpr, `count(*) DESC, value`, maxSiteFacets)
+	if err != nil {
+		return f, fmt.Errorf("sites: %w", err)
+	}
+	f.Months, err = db.facetCounts(q, monthExpr, `value DESC`, maxMonthFacets)
+	if err != nil {
+		return f, fmt.Errorf("months: %w", err)
+	}
+	return f, nil
+}
+
+func (db *DB) facetCounts(q SearchQuery, expr, order string, limit int) ([]FacetCount, error) {
+	where, args := q.where()
+	rows, err := db.read.Query(`
+	SELECT `+expr+` AS value, count(*)
+	FROM web_data
+	INNER JOIN search_index ON web_data.id = search_index.rowid
+	WHERE `+where+`
+	GROUP BY value
+	ORDER BY `+order+`
+	LIMIT ?`,
+		append(args, limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []FacetCount{}
+	for rows.Next() {
+		var c FacetCount
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"html/template"
@@ -20,6 +21,13 @@ import (
 var staticContent embed.FS
 var prefix = os.Getenv("PATH_PREFIX")
 
+// fuzzySearch controls whether a query with no results is automatically
+// retried with its spelling corrected.
+var fuzzySearch = envBool("SEARCH_FUZZY", false)
+
+// defaultSearchMode is the search mode used when the form doesn't pick one.
+var defaultSearchMode = os.Getenv("SEARCH_MODE")
+
 type PostPageRequest struct {
 	URL         string `json:"url"`
 	Title       string `json:"title"`
@@ -39,118 +47,268 @@ func scrapePageOptions(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func scrapePage(w http.ResponseWriter, r *http.Request) {
-	// Allow our response to be read by the extension at the calling site.
-	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+func makeScrapePage(store Store) func(w http.ResponseWriter, r *http.Request) {
+	alerts, _ := store.(AlertStore)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Allow our response to be read by the extension at the calling site.
+		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
-	defer r.Body.Close()
-	var content PostPageRequest
-	if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		log.Infof("POST /pages: Failed to decode JSON: %v", err)
-		return
-	}
-	if content.URL == "" || content.Title == "" || content.TextContent == "" {
-		http.Error(w, "Incomplete request", http.StatusBadRequest)
-		log.Infof("POST /pages: Incomplete request. URL=%t, title=%t, content=%t",
-			content.URL != "", content.Title != "", content.TextContent != "")
-		return
+		defer r.Body.Close()
+		var content PostPageRequest
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			log.Infof("POST /pages: Failed to decode JSON: %v", err)
+			return
+		}
+		if content.URL == "" || content.Title == "" || content.TextContent == "" {
+			http.Error(w, "Incomplete request", http.StatusBadRequest)
+			log.Infof("POST /pages: Incomplete request. URL=%t, title=%t, content=%t",
+				content.URL != "", content.Title != "", content.TextContent != "")
+			return
+		}
+
+		location, err := url.Parse(content.URL)
+		if err != nil {
+			http.Error(w, "Bad URL", http.StatusBadRequest)
+			log.Infof("POST /pages: Bad URL %q", content.URL)
+			return
+		}
+		minLocation := url.URL{
+			Scheme: location.Scheme,
+			Host:   location.Host,
+			Path:   location.Path,
+			// Some websites use the query to distinguish pages.
+			// E.g. Hacker News uses /items?id=X for posts.
+			RawQuery: location.RawQuery,
+		}
+
+		col := DataColumn{
+			ScrapedAt:   time.Now(),
+			URL:         minLocation.String(),
+			SafeTitle:   template.HTML(html.EscapeString(content.Title)),
+			SafeContent: template.HTML(html.EscapeString(content.TextContent)),
+		}
+
+		id, err := store.Save(col)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, `{"ok":false,"err":%q}`, err)
+			log.Infof("POST /pages: Failed to %q save in DB: %v", col.URL, err)
+			return
+		}
+
+		log.Infof("Scraped %d: %s", id, col.URL)
+
+		if alerts != nil {
+			matched, err := alerts.MatchSavedSearches(id, col)
+			if err != nil {
+				log.Warnf("POST /pages: Failed to check saved searches for %d: %v", id, err)
+			}
+			for _, a := range matched {
+				log.Infof("Page %d matched saved search %q", id, a.Search.Name)
+				go fireWebhook(a)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"ok":true,"id":%d}`, id) // Now that's fast JSON.
 	}
+}
 
-	location, err := url.Parse(content.URL)
-	if err != nil {
-		http.Error(w, "Bad URL", http.StatusBadRequest)
-		log.Infof("POST /pages: Bad URL %q", content.URL)
-		return
+// searchFromForm reads a search and its filters from the request's form values.
+func searchFromForm(r *http.Request) (SearchQuery, error) {
+	q := SearchQuery{
+		Query: r.FormValue("q"),
+		Site:  r.FormValue("site"),
+		Month: r.FormValue("month"),
+		Mode:  r.FormValue("mode"),
+	}
+	if q.Mode == "" {
+		q.Mode = defaultSearchMode
 	}
-	minLocation := url.URL{
-		Scheme: location.Scheme,
-		Host:   location.Host,
-		Path:   location.Path,
-		// Some websites use the query to distinguish pages.
-		// E.g. Hacker News uses /items?id=X for posts.
-		RawQuery: location.RawQuery,
+	if parsed, err := strconv.Atoi(r.FormValue("limit")); err == nil {
+		q.Limit = parsed
 	}
+	var err error
+	q.Cursor, err = ParseCursor(r.FormValue("cursor"))
+	return q, err
+}
 
-	col := DataColumn{
-		ScrapedAt:   time.Now(),
-		URL:         minLocation.String(),
-		SafeTitle:   template.HTML(html.EscapeString(content.Title)),
-		SafeContent: template.HTML(html.EscapeString(content.TextContent)),
+// searchOutcome is a page of search results and any spelling corrections made
+// along the way.
+type searchOutcome struct {
+	SearchPage
+	Suggestion string
+	Corrected  string
+	Took       time.Duration
+}
+
+// runSearch runs q, falling back to a spelling correction if nothing matches
+// and the store can correct spelling.
+func runSearch(store Store, q SearchQuery) (out searchOutcome, err error) {
+	if q.Query == "" {
+		return out, nil
 	}
 
-	id, err := db.Save(col)
+	start := time.Now()
+	defer func() { out.Took = time.Since(start) }()
+
+	out.SearchPage, err = store.Search(q)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"ok":false,"err":%q}`, err)
-		log.Infof("POST /pages: Failed to %q save in DB: %v", col.URL, err)
-		return
+		return out, err
+	}
+	speller, ok := store.(Speller)
+	if !ok || !q.Cursor.IsZero() || len(out.Results) != 0 {
+		return out, nil
 	}
 
-	log.Infof("Scraped %d: %s", id, col.URL)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"ok":true,"id":%d}`, id) // Now that's fast JSON.
+	out.Suggestion, err = speller.DidYouMean(q.Query)
+	if err != nil {
+		log.Warnf("search: failed to correct %q: %v", q.Query, err)
+		return out, nil
+	}
+	if out.Suggestion != "" && fuzzySearch {
+		corrected := q
+		corrected.Query = out.Suggestion
+		page, err := store.Search(corrected)
+		if err != nil {
+			log.Warnf("search: failed to query for corrected %q: %v", corrected.Query, err)
+			return out, nil
+		}
+		out.SearchPage = page
+		out.Corrected, out.Suggestion = out.Suggestion, ""
+	}
+	return out, nil
 }
 
-func makeSearch() func(w http.ResponseWriter, r *http.Request) {
+func makeSearch(store Store) func(w http.ResponseWriter, r *http.Request) {
 	searchTemplate := template.Must(template.ParseFS(staticContent, "static/search.template.html"))
+	alerts, _ := store.(AlertStore)
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.FormValue("q")
-		page := 0
-		if parsed, err := strconv.Atoi(r.FormValue("page")); err == nil {
-			page = parsed
+		q, err := searchFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.WithFacets = true
+		out, err := runSearch(store, q)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("search: failed to query for %q: %v", q.Query, err)
+			return
 		}
 
-		var results []SearchResult
-		if query != "" {
-			var err error
-			results, err = db.Search(query, page)
-			if err != nil {
-				http.Error(w, "Failed to query database", http.StatusInternalServerError)
-				log.Infof("search: failed to query for %q: %v", query, err)
-				return
+		var facets map[string][]facetLink
+		if out.Facets != nil {
+			facets = map[string][]facetLink{
+				"Sites":  facetLinks(prefix, r.URL, "site", out.Facets.Sites),
+				"Months": facetLinks(prefix, r.URL, "month", out.Facets.Months),
+			}
+		}
+
+		unseen := 0
+		if alerts != nil {
+			if unseen, err = alerts.UnseenAlerts(); err != nil {
+				log.Warnf("search: failed to count alerts: %v", err)
 			}
 		}
 
 		w.WriteHeader(http.StatusOK)
 		if err := searchTemplate.Execute(w, map[string]any{
-			"Root":       prefix,
-			"PageNum":    page,
-			"NextPage":   withPage(prefix, r.URL, +1),
-			"PrevPage":   withPage(prefix, r.URL, -1),
-			"Query":      query,
-			"NumResults": len(results),
-			"Results":    results,
+			"Root":           prefix,
+			"UnseenAlerts":   unseen,
+			"Deleted":        deletedFromForm(r),
+			"NextPage":       withCursor(prefix, r.URL, out.Next),
+			"PrevPage":       withCursor(prefix, r.URL, out.Prev),
+			"Total":          out.Total,
+			"Estimated":      out.Estimated,
+			"Took":           out.Took.Round(time.Millisecond),
+			"Query":          q.Query,
+			"Limit":          q.Limit,
+			"Site":           q.Site,
+			"Month":          q.Month,
+			"Hybrid":         q.Mode == HybridSearch,
+			"Suggestion":     out.Suggestion,
+			"SuggestionLink": withParam(prefix, r.URL, "q", out.Suggestion),
+			"Corrected":      out.Corrected,
+			"Facets":         facets,
+			"Results":        out.Results,
+			"Exports": map[string]string{
+				"csv":      exportLink(prefix, r.URL, "csv"),
+				"jsonl":    exportLink(prefix, r.URL, "jsonl"),
+				"markdown": exportLink(prefix, r.URL, "markdown"),
+			},
 		}); err != nil {
 			log.Errorf("failed to render search: %v", err)
 		}
 	}
 }
 
-func withPage(prefix string, in *url.URL, diff int) string {
+type facetLink struct {
+	FacetCount
+	// Link toggles the facet as a filter.
+	Link   string
+	Active bool
+}
+
+func facetLinks(prefix string, in *url.URL, key string, counts []FacetCount) []facetLink {
+	active := in.Query().Get(key)
+	links := make([]facetLink, len(counts))
+	for i, c := range counts {
+		links[i] = facetLink{FacetCount: c, Active: c.Value == active}
+		if links[i].Active {
+			links[i].Link = withParam(prefix, in, key, "")
+		} else {
+			links[i].Link = withParam(prefix, in, key, c.Value)
+		}
+	}
+	return links
+}
+
+// withCursor links to the same page starting at cursor c. There is no link if
+// c is nil.
+func withCursor(prefix string, in *url.URL, c *Cursor) string {
+	if c == nil {
+		return ""
+	}
 	u := &url.URL{}
 	*u = *in
 	vals := u.Query()
-	page := 0
-	if parsed, err := strconv.Atoi(vals.Get("page")); err == nil {
-		page = parsed
+	if c.IsZero() {
+		vals.Del("cursor")
+	} else {
+		vals.Set("cursor", c.String())
 	}
-	page += diff
-	if page < 0 {
-		return ""
+	u.RawQuery = vals.Encode()
+	u.Path = filepath.Join(prefix, u.Path)
+	return u.String()
+}
+
+// withParam links to the same page with one form value replaced, starting back
+// at the first page. An empty value removes it.
+func withParam(prefix string, in *url.URL, key, value string) string {
+	u := &url.URL{}
+	*u = *in
+	vals := u.Query()
+	if value == "" {
+		vals.Del(key)
+	} else {
+		vals.Set(key, value)
 	}
-	vals.Set("page", fmt.Sprintf("%d", page))
+	vals.Del("cursor")
 	u.RawQuery = vals.Encode()
 	u.Path = filepath.Join(prefix, u.Path)
 	return u.String()
 }
 
-func makeCachedPage() func(w http.ResponseWriter, r *http.Request) {
+func makeCachedPage(store Store) func(w http.ResponseWriter, r *http.Request) {
 	cachedTemplate := template.Must(template.ParseFS(staticContent, "static/cached.template.html"))
+	highlighter, _ := store.(Highlighter)
+	relatedFinder, _ := store.(RelatedFinder)
+	_, canPin := store.(RetentionStore)
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := strconv.Atoi(r.PathValue("id"))
 		if err != nil {
@@ -159,38 +317,77 @@ func makeCachedPage() func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		result, err := db.Fetch(int64(id))
+		result, err := store.Fetch(int64(id))
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Failed to query database", http.StatusInternalServerError)
 			log.Infof("cached page: failed to query for %d: %v", id, err)
 			return
 		}
 
+		query := r.FormValue("q")
+		matches := 0
+		if query != "" && highlighter != nil {
+			highlighted, n, err := highlighter.Highlight(int64(id), query)
+			if err != nil {
+				log.Warnf("cached page: failed to highlight %q in %d: %v", query, id, err)
+			} else if n > 0 {
+				result.SafeContent = highlighted
+				matches = n
+			}
+		}
+
+		var related []SearchResult
+		if relatedFinder != nil {
+			related, err = relatedFinder.Related(int64(id), 8)
+			if err != nil {
+				log.Warnf("cached page: failed to find pages related to %d: %v", id, err)
+			}
+		}
+
 		w.WriteHeader(http.StatusOK)
 		if err := cachedTemplate.Execute(w, map[string]any{
-			"Root":   prefix,
-			"Result": result,
+			"Root":    prefix,
+			"Result":  result,
+			"Query":   query,
+			"Matches": matches,
+			"Related": related,
+			"CanPin":  canPin,
 		}); err != nil {
 			log.Errorf("failed to render cached page template: %v", err)
 		}
 	}
 }
 
-func deletePage(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil {
-		log.Warnf("Invalid cached page id %q: %v", r.PathValue("id"), err)
-		http.Error(w, "Not Found", http.StatusNotFound)
-		return
-	}
+func makeDeletePage(store Store) func(w http.ResponseWriter, r *http.Request) {
+	_, undoable := store.(TrashStore)
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			log.Warnf("Invalid cached page id %q: %v", r.PathValue("id"), err)
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
 
-	err = db.Delete(int64(id))
-	if err != nil {
-		log.Warnf("Failed to delete page id %d: %v", id, err)
-		http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
-		return
+		err = store.Delete(int64(id))
+		if err != nil {
+			log.Warnf("Failed to delete page id %d: %v", id, err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if undoable {
+			goBackDeleted(w, r, int64(id))
+			return
+		}
+		goBack(w, r)
 	}
+}
 
+// goBack redirects to the page the request came from.
+func goBack(w http.ResponseWriter, r *http.Request) {
 	referTo := r.Header.Get("Referer")
 	if len(referTo) == 0 {
 		referTo = prefix
@@ -198,31 +395,44 @@ func deletePage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, referTo, http.StatusFound)
 }
 
-func makeHistory() func(w http.ResponseWriter, r *http.Request) {
+// historyFromForm reads the page of history to show from the request's form
+// values.
+func historyFromForm(r *http.Request) (Cursor, int, error) {
+	limit := 0
+	if parsed, err := strconv.Atoi(r.FormValue("limit")); err == nil {
+		limit = parsed
+	}
+	from, err := ParseCursor(r.FormValue("cursor"))
+	return from, limit, err
+}
+
+func makeHistory(store Store) func(w http.ResponseWriter, r *http.Request) {
 	searchTemplate := template.Must(template.ParseFS(staticContent, "static/history.template.html"))
 	return func(w http.ResponseWriter, r *http.Request) {
-		page := 0
-		if parsed, err := strconv.Atoi(r.FormValue("page")); err == nil {
-			page = parsed
+		from, limit, err := historyFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		var results []SearchResult
-		var err error
-		results, err = db.History(page)
+		start := time.Now()
+		page, err := store.History(from, limit)
 		if err != nil {
 			http.Error(w, "Failed to query database", http.StatusInternalServerError)
 			log.Infof("search: failed to query for history: %v", err)
 			return
 		}
+		took := time.Since(start)
 
 		w.WriteHeader(http.StatusOK)
 		if err := searchTemplate.Execute(w, map[string]any{
-			"Root":       prefix,
-			"PageNum":    page,
-			"NextPage":   withPage(prefix, r.URL, +1),
-			"PrevPage":   withPage(prefix, r.URL, -1),
-			"NumResults": len(results),
-			"Results":    results,
+			"Root":     prefix,
+			"Deleted":  deletedFromForm(r),
+			"NextPage": withCursor(prefix, r.URL, page.Next),
+			"PrevPage": withCursor(prefix, r.URL, page.Prev),
+			"Total":    page.Total,
+			"Took":     took.Round(time.Millisecond),
+			"Results":  page.Results,
 		}); err != nil {
 			log.Errorf("failed to render history: %v", err)
 		}
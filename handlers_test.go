@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestServer serves every route from an in-memory store, with no login.
+func newTestServer(t *testing.T) (*MemStore, *httptest.Server) {
+	store := NewMemStore()
+	mux := http.NewServeMux()
+	routes(mux, store, func(h http.Handler) http.Handler { return h })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return store, srv
+}
+
+// noRedirects stops the client at the first response so redirects can be
+// checked.
+var noRedirects = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func TestHandlers(t *testing.T) {
+	store, srv := newTestServer(t)
+	id := mustSave(t, store, testPage("https://a.com/cats", "All about cats", "cats are small & furry"))
+	mustSave(t, store, testPage("https://b.com/dogs", "Dogs", "dogs bark"))
+
+	table := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+		// wantBody must be in the response.
+		wantBody string
+	}{{
+		name:     "search",
+		path:     "/search?q=cats",
+		wantCode: http.StatusOK,
+		wantBody: "All about cats",
+	}, {
+		name:     "search escapes content",
+		path:     "/search?q=furry",
+		wantCode: http.StatusOK,
+		wantBody: "small &amp; furry",
+	}, {
+		name:     "search bad cursor",
+		path:     "/search?q=cats&cursor=!!",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "search api",
+		path:     "/api/search?q=dogs",
+		wantCode: http.StatusOK,
+		wantBody: `"url":"https://b.com/dogs"`,
+	}, {
+		name:     "history",
+		path:     "/history",
+		wantCode: http.StatusOK,
+		wantBody: "Dogs",
+	}, {
+		name:     "history api",
+		path:     "/api/history?limit=1",
+		wantCode: http.StatusOK,
+		wantBody: `"next":`,
+	}, {
+		name:     "cached page",
+		path:     "/pages/" + itoa(id),
+		wantCode: http.StatusOK,
+		wantBody: "cats are small &amp; furry",
+	}, {
+		name:     "cached page missing",
+		path:     "/pages/999",
+		wantCode: http.StatusNotFound,
+	}, {
+		name:     "cached page bad id",
+		path:     "/pages/cats",
+		wantCode: http.StatusNotFound,
+	}, {
+		name:     "save incomplete",
+		method:   "POST",
+		path:     "/pages",
+		body:     `{"url":"https://c.com/"}`,
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "save invalid",
+		method:   "POST",
+		path:     "/pages",
+		body:     `{`,
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "opensearch",
+		path:     "/opensearch.xml",
+		wantCode: http.StatusOK,
+		wantBody: "/search?q={searchTerms}",
+	}, {
+		name:     "unsupported feature",
+		path:     "/api/suggest?q=ca",
+		wantCode: http.StatusNotImplemented,
+	}}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = "GET"
+			}
+			req, err := http.NewRequest(method, srv.URL+tc.path, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, body := do(t, req)
+			if resp.StatusCode != tc.wantCode {
+				t.Errorf("%s %s returned %d, wanted %d: %s", method, tc.path, resp.StatusCode, tc.wantCode, body)
+			}
+			if !strings.Contains(body, tc.wantBody) {
+				t.Errorf("%s %s returned %q, wanted it to contain %q", method, tc.path, body, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestScrapeSearchDelete(t *testing.T) {
+	_, srv := newTestServer(t)
+
+	// Save a page like the extension does.
+	req, _ := http.NewRequest("POST", srv.URL+"/pages",
+		strings.NewReader(`{"url":"https://c.com/post?id=1#top","title":"Owls <3","text":"owls hoot at night"}`))
+	resp, body := do(t, req)
+	var saved struct {
+		OK bool  `json:"ok"`
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(body), &saved); err != nil || !saved.OK {
+		t.Fatalf("POST /pages returned %d %q", resp.StatusCode, body)
+	}
+
+	// It is searchable, without the fragment and with the title escaped.
+	var results apiSearchResponse
+	searchOwls := func() {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/api/search?q=owls", nil)
+		_, body := do(t, req)
+		results = apiSearchResponse{}
+		if err := json.Unmarshal([]byte(body), &results); err != nil {
+			t.Fatalf("bad search response %q: %v", body, err)
+		}
+	}
+	searchOwls()
+	if len(results.Results) != 1 {
+		t.Fatalf("search for saved page returned %+v", results)
+	}
+	if got := results.Results[0]; got.URL != "https://c.com/post?id=1" || got.Title != "Owls <3" {
+		t.Errorf("saved page is %+v", got)
+	}
+
+	// Deleting it sends us back where we came from.
+	req, _ = http.NewRequest("GET", srv.URL+"/pages/"+itoa(saved.ID)+"/delete", nil)
+	req.Header.Set("Referer", "/history")
+	resp, _ = do(t, req)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/history" {
+		t.Errorf("delete returned %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	searchOwls()
+	if len(results.Results) != 0 {
+		t.Errorf("search after delete returned %+v", results.Results)
+	}
+}
+
+func do(t *testing.T, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: read body: %v", req.Method, req.URL, err)
+	}
+	return resp, string(body)
+}
+
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
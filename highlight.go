@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Private use characters mark matches in highlight() output. They can't be
+// mistaken for HTML, which the content already is.
+const (
+	hitStart = "\uE000"
+	hitEnd   = "\uE001"
+)
+
+// Highlight marks every match of query in the content of a page, using the
+// full text index so that matches follow the same tokenizing and stemming as
+// search. Each match gets an anchor with links to the previous and next
+// match. It returns the marked up content and the number of matches, which is
+// zero if the page doesn't match the query at all.
+func (db *DB) Highlight(id int64, query string) (template.HTML, int, error) {
+	if db.contentless {
+		return db.highlightTerms(id, query)
+	}
+	var marked string
+	err := db.read.QueryRow(`
+	SELECT highlight(search_index, 0, ?, ?)
+	FROM search_index
+	WHERE search_index MATCH ? AND rowid = ?`,
+		hitStart, hitEnd, query, id,
+	).Scan(&marked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	safe, n := numberHits(skipEntities(marked))
+	return safe, n, nil
+}
+
+// skipEntities unmarks the parts of matches that fall inside an HTML entity.
+// The index tokenizes the escaped content, so "amp" matches the inside of
+// "&amp;", and marking it would break the entity.
+func skipEntities(marked string) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(marked, hitStart)
+		end := strings.Index(marked, hitEnd)
+		if start < 0 || end < start {
+			b.WriteString(marked)
+			return b.String()
+		}
+		b.WriteString(marked[:start])
+		hit := marked[start+len(hitStart) : end]
+		marked = marked[end+len(hitEnd):]
+
+		// Tokens in entities follow "&" or "&#" and end at ";".
+		var head, tail string
+		if before := b.String(); strings.HasSuffix(before, "&") || strings.HasSuffix(before, "&#") {
+			i := strings.IndexByte(hit, ';')
+			if i < 0 {
+				i = len(hit) - 1
+			}
+			head, hit = hit[:i+1], hit[i+1:]
+		}
+		if strings.HasPrefix(marked, ";") {
+			i := strings.LastIndexByte(hit, '&')
+			if i < 0 {
+				i = 0
+			}
+			hit, tail = hit[:i], hit[i:]
+		}
+		trimmed := strings.TrimSpace(hit)
+		if trimmed == "" {
+			b.WriteString(head + hit + tail)
+			continue
+		}
+		i := strings.Index(hit, trimmed)
+		b.WriteString(head + hit[:i] + hitStart + trimmed + hitEnd + hit[i+len(trimmed):] + tail)
+	}
+}
+
+// numberHits turns the match markers into anchors hit-1 through hit-n. The
+// navigation links wrap around at either end.
+func numberHits(marked string) (template.HTML, int) {
+	total := strings.Count(marked, hitStart)
+	var b strings.Builder
+	for n := 1; ; n++ {
+		start := strings.Index(marked, hitStart)
+		end := strings.Index(marked, hitEnd)
+		if start < 0 || end < start {
+			b.WriteString(marked)
+			break
+		}
+		prev, next := n-1, n+1
+		if prev < 1 {
+			prev = total
+		}
+		if next > total {
+			next = 1
+		}
+		b.WriteString(marked[:start])
+		fmt.Fprintf(&b, `<a class="hit-nav" href="#hit-%d">‹</a><mark id="hit-%d">%s</mark><a class="hit-nav" href="#hit-%d">›</a>`,
+			prev, n, marked[start+len(hitStart):end], next)
+		marked = marked[end+len(hitEnd):]
+	}
+	return template.HTML(b.String()), total
+}
+
+// highlightTerms stands in for highlight() when the index is contentless and
+// can't mark matches itself. It marks the words of the page that start like
+// a word of the query, see queryTerms.
+func (db *DB) highlightTerms(id int64, query string) (template.HTML, int, error) {
+	var matched bool
+	err := db.read.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM search_index WHERE search_index MATCH ? AND rowid = ?)`,
+		query, id,
+	).Scan(&matched)
+	if err != nil || !matched {
+		return "", 0, err
+	}
+	page, err := db.Fetch(id)
+	if err != nil {
+		return "", 0, err
+	}
+	marked, _ := markTerms(string(page.SafeContent), queryTerms(query), hitStart, hitEnd)
+	safe, n := numberHits(marked)
+	return safe, n, nil
+}
+
+// queryWord is a word of a full text query, with the colon after it if it
+// names a column.
+var queryWord = regexp.MustCompile(`[\p{L}\p{N}]+(\s*:)?`)
+
+// queryTerms picks the words out of a full text query for matching in Go,
+// leaving out operators and column names. They are lower cased and shorn of
+// common suffixes, a rough stand in for the index's stemming.
+func queryTerms(query string) []string {
+	var terms []string
+	for _, word := range queryWord.FindAllString(query, -1) {
+		switch {
+		case strings.HasSuffix(word, ":"):
+			continue
+		case word == "AND" || word == "OR" || word == "NOT" || word == "NEAR":
+			continue
+		}
+		term := strings.ToLower(word)
+		for _, suffix := range []string{"ing", "ed", "es", "s"} {
+			if stem, ok := strings.CutSuffix(term, suffix); ok && len([]rune(stem)) >= 3 {
+				term = stem
+				break
+			}
+		}
+		if !slices.Contains(terms, term) {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// matchesTerm reports whether an escaped word starts with one of the terms.
+func matchesTerm(safeWord string, terms []string) bool {
+	word := strings.TrimFunc(strings.ToLower(html.UnescapeString(safeWord)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, term := range terms {
+		if strings.HasPrefix(word, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// markTerms wraps the words of escaped text that match the terms in open and
+// close, keeping the spacing between words. It returns the marked text and the
+// number of words marked.
+func markTerms(safe string, terms []string, open, close string) (string, int) {
+	var b strings.Builder
+	n := 0
+	for safe != "" {
+		start := strings.IndexFunc(safe, func(r rune) bool { return !unicode.IsSpace(r) })
+		if start < 0 {
+			b.WriteString(safe)
+			break
+		}
+		b.WriteString(safe[:start])
+		safe = safe[start:]
+		end := strings.IndexFunc(safe, unicode.IsSpace)
+		if end < 0 {
+			end = len(safe)
+		}
+		word := safe[:end]
+		safe = safe[end:]
+		if matchesTerm(word, terms) {
+			b.WriteString(open + word + close)
+			n++
+		} else {
+			b.WriteString(word)
+		}
+	}
+	return b.String(), n
+}
+
+// termSnippet stands in for snippet() when the index is contentless. It shows
+// about n words around the first match in the content, or failing that the
+// title, and reports whether either matched.
+func termSnippet(col DataColumn, terms []string, n int) (template.HTML, bool) {
+	for _, safe := range []template.HTML{col.SafeContent, col.SafeTitle} {
+		words := strings.Fields(string(safe))
+		first := slices.IndexFunc(words, func(w string) bool { return matchesTerm(w, terms) })
+		if first < 0 {
+			continue
+		}
+		start := max(0, first-n/4)
+		end := min(len(words), start+n)
+		marked, _ := markTerms(strings.Join(words[start:end], " "), terms, "<b>", "</b>")
+		if start > 0 {
+			marked = "..." + marked
+		}
+		if end < len(words) {
+			marked += "..."
+		}
+		return template.HTML(marked), true
+	}
+	return "", false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHighlightEntities(t *testing.T) {
+	db := newEncryptedDB(t, filepath.Join(t.TempDir(), "palace.db"), nil)
+	id := mustSave(t, db, testPage("https://amp.dev/", "AMP", `amp pages & "quotes" <lt> it's`))
+
+	table := []struct {
+		query string
+		wantN int
+	}{
+		{"amp", 1},
+		{"quotes", 1},
+		{"34", 0},
+		{"lt", 1},
+		{"39", 0},
+		{`"amp pages"`, 1},
+	}
+	for _, tc := range table {
+		safe, n, err := db.Highlight(id, tc.query)
+		if err != nil {
+			t.Fatalf("Highlight(%q): %v", tc.query, err)
+		}
+		if n != tc.wantN {
+			t.Errorf("Highlight(%q) found %d matches, wanted %d: %s", tc.query, n, tc.wantN, safe)
+		}
+		for _, entity := range []string{"&amp;", "&#34;", "&lt;", "&gt;", "&#39;"} {
+			if !strings.Contains(string(safe), entity) {
+				t.Errorf("Highlight(%q) broke %s: %s", tc.query, entity, safe)
+			}
+		}
+	}
+}
+
+func TestSkipEntities(t *testing.T) {
+	mark := func(s string) string {
+		return strings.NewReplacer("[", hitStart, "]", hitEnd).Replace(s)
+	}
+	table := []struct {
+		marked, want string
+	}{
+		{"[amp] &[amp];", "[amp] &amp;"},
+		{"&#[39]; &[lt];", "&#39; &lt;"},
+		{"&[amp; foo]", "&amp; [foo]"},
+		{"[foo &amp]; bar", "[foo] &amp; bar"},
+		{"&[amp;&lt];", "&amp;&lt;"},
+		{"no hits", "no hits"},
+	}
+	for _, tc := range table {
+		if got := skipEntities(mark(tc.marked)); got != mark(tc.want) {
+			t.Errorf("skipEntities(%q) = %q, wanted %q", tc.marked, got, mark(tc.want))
+		}
+	}
+}
@@ -1,46 +1,252 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/spencer-p/palace/pkg/auth"
 )
 
-var db DB
-
 func main() {
-	var err error
-	db, err = NewDB(os.Getenv("DB_FILE"))
+	dryRun := flag.Bool("dry-run", false, "list the database migrations that would be applied and exit")
+	maintain := flag.String("maintain", "", "run comma separated maintenance operations on DB_FILE and exit: "+strings.Join(maintenanceOpNames(), ", "))
+	backup := flag.Bool("backup", false, "back up DB_FILE to BACKUP_DIR and exit")
+	restoreTo := flag.String("restore-to", "", "rebuild DB_FILE from REPLICA_DIR as it was at an RFC 3339 time, or \"latest\", and exit")
+	restore := flag.String("restore", "", "replace DB_FILE with a backup, given as a path or a name in BACKUP_DIR, and exit")
+	flag.Parse()
+
+	if *dryRun {
+		reportMigrations()
+		return
+	}
+	if *maintain != "" {
+		db, err := NewDB(os.Getenv("DB_FILE"))
+		if err != nil {
+			log.Fatalf("Prepare database: %v", err)
+		}
+		db.Keys = contentKeys
+		ok := runMaintenance(db, strings.Split(*maintain, ","))
+		db.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if *backup {
+		db, err := NewDB(os.Getenv("DB_FILE"))
+		if err != nil {
+			log.Fatalf("Prepare database: %v", err)
+		}
+		b, err := backupConfig.Backup(db)
+		db.Close()
+		if err != nil {
+			log.Fatalf("Back up: %v", err)
+		}
+		fmt.Printf("Backed up to %s (%d bytes)\n", filepath.Join(backupConfig.Dir, b.Name), b.Size)
+		return
+	}
+	if *restoreTo != "" {
+		var at time.Time
+		if *restoreTo != "latest" {
+			var err error
+			if at, err = time.Parse(time.RFC3339, *restoreTo); err != nil {
+				log.Fatalf("Restore: %v", err)
+			}
+		}
+		restoredTo, err := RestoreReplica(replicaDir, at, backupConfig, os.Getenv("DB_FILE"))
+		if err != nil {
+			log.Fatalf("Restore: %v", err)
+		}
+		fmt.Printf("Restored the database as of %v\n", restoredTo.Local())
+		return
+	}
+	if *restore != "" {
+		if err := backupConfig.Restore(*restore, os.Getenv("DB_FILE")); err != nil {
+			log.Fatalf("Restore: %v", err)
+		}
+		fmt.Printf("Restored %s\n", *restore)
+		return
+	}
+
+	auth.Setup()
+	store, err := openStore()
 	if err != nil {
 		log.Fatalf("Prepare database: %v", err)
 	}
 
 	mux := http.NewServeMux()
 	usersDB := fakeUsersDB{}
-	authhandle := func(path string, f func(w http.ResponseWriter, r *http.Request)) {
-		mux.Handle(path, auth.OnlyAuthenticated(usersDB, http.HandlerFunc(f)))
-	}
-
 	mux.HandleFunc("GET /login", auth.GetLogin)
 	mux.Handle("POST /login", auth.PostLogin(usersDB))
+	routes(mux, store, func(h http.Handler) http.Handler {
+		return auth.OnlyAuthenticated(usersDB, h)
+	})
 
-	mux.Handle("/{$}", http.RedirectHandler(filepath.Join(os.Getenv("PATH_PREFIX"), "/search"), http.StatusFound))
-	authhandle("/search", makeSearch())
-	authhandle("/history", makeHistory())
+	log.Infof("Starting server")
+	log.Errorf("listen and serve: %v", http.ListenAndServe(":6844", logWrap(mux)))
+}
+
+// openStore connects to Postgres if DB_URL is set, and otherwise opens the
+// SQLite database in DB_FILE.
+func openStore() (Store, error) {
+	weights := ColumnWeights{
+		Content: envFloat("SEARCH_WEIGHT_CONTENT", DefaultWeights.Content),
+		Title:   envFloat("SEARCH_WEIGHT_TITLE", DefaultWeights.Title),
+	}
+	if url := os.Getenv("DB_URL"); url != "" {
+		if contentKeys != nil {
+			return nil, fmt.Errorf("CONTENT_KEY is only supported with SQLite")
+		}
+		pg, err := NewPGStore(url)
+		if err != nil {
+			return nil, err
+		}
+		pg.Weights = weights
+		return pg, nil
+	}
+
+	if replicaDir == "" {
+		return openSQLite(weights, nil)
+	}
+	return openSQLite(weights, replicaPragmas)
+}
+
+// openSQLite opens the SQLite database in DB_FILE and starts its background
+// jobs.
+func openSQLite(weights ColumnWeights, connPragmas []string) (Store, error) {
+	db, err := NewDB(os.Getenv("DB_FILE"), connPragmas...)
+	if err != nil {
+		return nil, err
+	}
+	db.Weights = weights
+	db.Keys = contentKeys
+	if err := db.ApplyKeys(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply CONTENT_KEY: %w", err)
+	}
+	if replicaDir != "" {
+		if db.replica, err = NewReplicator(db, replicaDir, backupConfig); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to start replication: %w", err)
+		}
+		go db.replica.Run(replicaSyncInterval)
+	}
+	if envBool("SEARCH_EMBEDDINGS", true) {
+		go backfillEmbeddings(db)
+	} else {
+		db.Embedder = nil
+	}
+	go applyVersionRules(db)
+	if backupConfig.Dir != "" && backupInterval > 0 {
+		go runBackups(db, backupConfig, backupInterval)
+	}
+	if maintenanceHour >= 0 {
+		go runNightlyMaintenance(db, maintenanceHour, nightlyOps)
+	}
+	if !retention.IsZero() {
+		go runJanitor(db, retention, retentionInterval)
+	}
+	if trashPeriod > 0 {
+		go runTrashPurge(db, trashPeriod, trashInterval)
+	}
+	return db, nil
+}
+
+// routes registers every page backed by the store. Pages behind a login are
+// wrapped with protect. Pages for features the store lacks are Not Implemented.
+func routes(mux *http.ServeMux, store Store, protect func(http.Handler) http.Handler) {
+	authhandle := func(path string, f func(w http.ResponseWriter, r *http.Request)) {
+		mux.Handle(path, protect(http.HandlerFunc(f)))
+	}
+
+	mux.HandleFunc("GET /opensearch.xml", makeOpenSearch())
+	mux.Handle("/{$}", http.RedirectHandler(filepath.Join(prefix, "/search"), http.StatusFound))
+	authhandle("/search", makeSearch(store))
+	authhandle("/history", makeHistory(store))
+	authhandle("GET /timeline", optional(store, makeTimeline))
+	authhandle("GET /timeline/{date}", optional(store, makeTimeline))
+	authhandle("GET /calendar", optional(store, makeCalendar))
+	authhandle("GET /quote", optional(store, makeQuote))
+	authhandle("GET /inbox", optional(store, makeInbox))
+	authhandle("POST /inbox/seen", optional(store, makeMarkAlertsSeen))
+	authhandle("GET /versions", optional(store, makeVersions))
+	authhandle("POST /versions", optional(store, makePostVersionRule))
+	authhandle("GET /versions/{id}/delete", optional(store, makeDeleteVersionRule))
+	authhandle("POST /searches", optional(store, makePostSavedSearch))
+	authhandle("GET /searches/{id}/delete", optional(store, makeDeleteSavedSearch))
+	authhandle("GET /api/search", makeSearchAPI(store))
+	authhandle("GET /api/history", makeHistoryAPI(store))
+	authhandle("GET /api/export", optional(store, makeExport))
+	authhandle("GET /api/suggest", optional(store, makeSuggest))
+	authhandle("GET /api/quote", optional(store, makeQuoteAPI))
+	authhandle("GET /api/opensearch/suggest", optional(store, makeOpenSearchSuggest))
 
 	mux.HandleFunc("OPTIONS /pages", scrapePageOptions)
-	authhandle("POST /pages", scrapePage)
-	authhandle("GET /pages/{id}", makeCachedPage())
-	authhandle("GET /pages/{id}/delete", deletePage)
+	authhandle("POST /pages", makeScrapePage(store))
+	authhandle("GET /pages/{id}", makeCachedPage(store))
+	authhandle("GET /pages/{id}/delete", makeDeletePage(store))
+	authhandle("GET /pages/{id}/pin", optional(store, makePinPage))
+	authhandle("GET /pages/{id}/restore", optional(store, makeRestorePage))
+	authhandle("GET /pages/{id}/purge", optional(store, makePurgePage))
+	authhandle("GET /trash", optional(store, makeTrash))
+	authhandle("POST /trash/empty", optional(store, makeEmptyTrash))
+	authhandle("GET /api/retention", optional(store, makeRetentionPreview))
+	authhandle("GET /api/backups", optional(store, makeBackups))
+	authhandle("POST /api/backups", optional(store, makePostBackup))
+	authhandle("GET /maintenance", optional(store, makeMaintenance))
+	authhandle("POST /maintenance/{op}", optional(store, makePostMaintenance))
+	authhandle("GET /api/maintenance", optional(store, makeMaintenanceAPI))
+	authhandle("POST /api/maintenance/{op}", optional(store, makePostMaintenanceAPI))
+	authhandle("GET /stats", optional(store, makeStats))
+	authhandle("GET /api/stats", optional(store, makeStatsAPI))
 
 	mux.Handle("GET /static/", http.FileServer(http.FS(staticContent)))
+}
 
-	log.Infof("Starting server")
-	log.Errorf("listen and serve: %v", http.ListenAndServe(":6844", logWrap(mux)))
+// optional makes a handler for a feature that not every store has.
+func optional[T any](store Store, makeHandler func(T) func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if s, ok := store.(T); ok {
+		return makeHandler(s)
+	}
+	return notImpl
+}
+
+// reportMigrations prints the migrations the database is missing without
+// applying them.
+func reportMigrations() {
+	var db interface {
+		SchemaVersion() (int, error)
+		PendingMigrations() ([]migration, error)
+		Close() error
+	}
+	var err error
+	if url := os.Getenv("DB_URL"); url != "" {
+		db, err = OpenPGStore(url)
+	} else {
+		db, err = OpenDB(os.Getenv("DB_FILE"))
+	}
+	if err != nil {
+		log.Fatalf("Open database: %v", err)
+	}
+	defer db.Close()
+	version, err := db.SchemaVersion()
+	if err != nil {
+		log.Fatalf("Read schema version: %v", err)
+	}
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		log.Fatalf("Check migrations: %v", err)
+	}
+	fmt.Printf("Schema version %d, %d migrations pending\n", version, len(pending))
+	for _, m := range pending {
+		fmt.Printf("  %s\n", m)
+	}
 }
 
 func notImpl(w http.ResponseWriter, _ *http.Request) {
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/prettytime"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// maintenanceHour is the local hour of the nightly maintenance, or negative to
+// skip it.
+var maintenanceHour = envInt("MAINTENANCE_HOUR", 3)
+
+// nightlyOps are the operations run every night. Rebuilding and vacuuming
+// take a long time on big databases, so they are left to be run by hand.
+var nightlyOps = strings.Split(cmp.Or(os.Getenv("MAINTENANCE_OPS"), "integrity-check,optimize,analyze,checkpoint"), ",")
+
+// mergePages is how much work an FTS5 merge does, in pages written.
+const mergePages = 500
+
+// ErrUnknownOp is returned for maintenance that doesn't exist.
+var ErrUnknownOp = errors.New("unknown maintenance operation")
+
+type maintenanceOp struct {
+	Doc string
+	Run func(db *DB) (string, error)
+}
+
+// maintenanceOps are the operations that can be run on the database. Each
+// returns a short description of what it did.
+var maintenanceOps = map[string]maintenanceOp{
+	"optimize": {
+		Doc: "merge the full text index into a single b-tree",
+		Run: func(db *DB) (string, error) {
+			_, err := db.Exec(`INSERT INTO search_index(search_index) VALUES ('optimize')`)
+			return "", err
+		},
+	},
+	"merge": {
+		Doc: "merge some of the full text index's segments",
+		Run: func(db *DB) (string, error) {
+			_, err := db.Exec(`INSERT INTO search_index(search_index, rank) VALUES ('merge', ?)`, mergePages)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("merged up to %d pages", mergePages), nil
+		},
+	},
+	"integrity-check": {
+		Doc: "check the full text index against the pages",
+		Run: func(db *DB) (string, error) {
+			_, err := db.Exec(`INSERT INTO search_index(search_index, rank) VALUES ('integrity-check', 1)`)
+			if isCorrupt(err) {
+				return "", fmt.Errorf("index is corrupt, rebuild it: %w", err)
+			}
+			if err != nil {
+				return "", err
+			}
+			return "index is consistent", nil
+		},
+	},
+	"rebuild": {
+		Doc: "rebuild the full text index from the pages",
+		Run: func(db *DB) (string, error) {
+			if db.contentless {
+				return "", db.reindex()
+			}
+			_, err := db.Exec(`INSERT INTO search_index(search_index) VALUES ('rebuild')`)
+			return "", err
+		},
+	},
+	"vacuum": {
+		Doc: "rewrite the database file to reclaim free space",
+		Run: func(db *DB) (string, error) {
+			before, _ := db.fileSize()
+			if _, err := db.Exec(`VACUUM`); err != nil {
+				return "", err
+			}
+			after, _ := db.fileSize()
+			return fmt.Sprintf("%d bytes before, %d after", before, after), nil
+		},
+	},
+	"analyze": {
+		Doc: "update the statistics used to plan queries",
+		Run: func(db *DB) (string, error) {
+			_, err := db.Exec(`ANALYZE`)
+			return "", err
+		},
+	},
+	"checkpoint": {
+		Doc: "copy the write-ahead log into the database and truncate it",
+		Run: func(db *DB) (string, error) {
+			if db.replica != nil {
+				return db.replica.Checkpoint()
+			}
+			var busy, logPages, checkpointed int
+			err := db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logPages, &checkpointed)
+			if err != nil {
+				return "", err
+			}
+			if busy != 0 {
+				return "", fmt.Errorf("checkpoint blocked, %d of %d pages copied", checkpointed, logPages)
+			}
+			return fmt.Sprintf("%d pages copied", checkpointed), nil
+		},
+	},
+}
+
+// isCorrupt reports whether err is one of SQLite's SQLITE_CORRUPT codes.
+func isCorrupt(err error) bool {
+	sqliteErr := &sqlite.Error{}
+	return errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == sqlite3.SQLITE_CORRUPT
+}
+
+// maintenanceOpNames lists the maintenance operations in order.
+func maintenanceOpNames() []string {
+	names := make([]string, 0, len(maintenanceOps))
+	for name := range maintenanceOps {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// fileSize is the size of the database in bytes.
+func (db *DB) fileSize() (int64, error) {
+	var size int64
+	err := db.read.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&size)
+	return size, err
+}
+
+// filename is the path of the database file.
+func (db *DB) filename() (string, error) {
+	var file string
+	if err := db.read.QueryRow(`SELECT file FROM pragma_database_list WHERE name = 'main'`).Scan(&file); err != nil {
+		return "", fmt.Errorf("failed to find database file: %w", err)
+	}
+	return file, nil
+}
+
+// MaintenanceRun is the result of a maintenance operation.
+type MaintenanceRun struct {
+	ID        int64         `json:"id"`
+	Op        string        `json:"op"`
+	StartedAt time.Time     `json:"started_at"`
+	Took      time.Duration `json:"-"`
+	TookMS    int64         `json:"took_ms"`
+	OK        bool          `json:"ok"`
+	Detail    string        `json:"detail,omitempty"`
+
+	StartedAgo string `json:"-"`
+}
+
+// Maintain runs a maintenance operation and records the result. A failed
+// operation is recorded and returned with its error.
+func (db *DB) Maintain(op string) (MaintenanceRun, error) {
+	m, ok := maintenanceOps[op]
+	if !ok {
+		return MaintenanceRun{}, fmt.Errorf("%w %q", ErrUnknownOp, op)
+	}
+
+	run := MaintenanceRun{Op: op, StartedAt: time.Now()}
+	detail, opErr := m.Run(db)
+	run.Took = time.Since(run.StartedAt)
+	run.TookMS = run.Took.Milliseconds()
+	run.OK = opErr == nil
+	run.Detail = detail
+	if opErr != nil {
+		run.Detail = opErr.Error()
+	}
+
+	err := db.QueryRow(`
+	INSERT INTO maintenance_runs(op, started_at, took_ms, ok, detail) VALUES (?, ?, ?, ?, ?)
+	RETURNING id`,
+		run.Op, run.StartedAt.Format(ISO8601TZ), run.TookMS, run.OK, run.Detail,
+	).Scan(&run.ID)
+	if err != nil {
+		log.Warnf("Failed to record %s: %v", op, err)
+	}
+	return run, opErr
+}
+
+// MaintenanceRuns lists the most recent maintenance, newest first.
+func (db *DB) MaintenanceRuns(limit int) ([]MaintenanceRun, error) {
+	rows, err := db.read.Query(`
+	SELECT id, op, started_at, took_ms, ok, detail
+	FROM maintenance_runs
+	ORDER BY id DESC
+	LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	runs := []MaintenanceRun{}
+	for rows.Next() {
+		var run MaintenanceRun
+		var startTime string
+		if err := rows.Scan(&run.ID, &run.Op, &startTime, &run.TookMS, &run.OK, &run.Detail); err != nil {
+			return nil, fmt.Errorf("run %d: scan: %w", len(runs), err)
+		}
+		t, err := timeFromDB(startTime)
+		if err != nil {
+			return nil, fmt.Errorf("run %d: %w", len(runs), err)
+		}
+		run.StartedAt = t
+		run.StartedAgo = prettytime.DurationBetween(now, t)
+		run.Took = time.Duration(run.TookMS) * time.Millisecond
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// runMaintenance runs each operation in turn, logging the results, and
+// reports whether they all succeeded.
+func runMaintenance(store Maintainer, ops []string) bool {
+	ok := true
+	for _, op := range ops {
+		run, err := store.Maintain(strings.TrimSpace(op))
+		if err != nil {
+			log.Errorf("Maintenance %s failed after %v: %v", op, run.Took, err)
+			ok = false
+			continue
+		}
+		log.Infof("Maintenance %s took %v: %s", op, run.Took, cmp.Or(run.Detail, "done"))
+	}
+	return ok
+}
+
+// nextMaintenance is the next time after now on the hour.
+func nextMaintenance(now time.Time, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// runNightlyMaintenance runs the nightly operations at the maintenance hour
+// every day. It is meant to be run in the background.
+func runNightlyMaintenance(store Maintainer, hour int, ops []string) {
+	for {
+		time.Sleep(time.Until(nextMaintenance(time.Now(), hour)))
+		runMaintenance(store, ops)
+	}
+}
+
+func makeMaintenance(store Maintainer) func(w http.ResponseWriter, r *http.Request) {
+	maintenanceTemplate := template.Must(template.ParseFS(staticContent, "static/maintenance.template.html"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		runs, err := store.MaintenanceRuns(50)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("maintenance: failed to query runs: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if err := maintenanceTemplate.Execute(w, map[string]any{
+			"Root": prefix,
+			"Ops":  maintenanceOps,
+			"Runs": runs,
+		}); err != nil {
+			log.Errorf("failed to render maintenance: %v", err)
+		}
+	}
+}
+
+// makePostMaintenance runs the operation in the path, then goes back to the
+// maintenance page.
+func makePostMaintenance(store Maintainer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op := r.PathValue("op")
+		if _, err := store.Maintain(op); errors.Is(err, ErrUnknownOp) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, prefix+"/maintenance", http.StatusFound)
+	}
+}
+
+func makeMaintenanceAPI(store Maintainer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		runs, err := store.MaintenanceRuns(pageSize(limit))
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("maintenance api: failed to query runs: %v", err)
+			return
+		}
+		writeJSON(w, runs)
+	}
+}
+
+// makePostMaintenanceAPI runs the operation in the path and responds with the
+// result, failed or not.
+func makePostMaintenanceAPI(store Maintainer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		run, err := store.Maintain(r.PathValue("op"))
+		if errors.Is(err, ErrUnknownOp) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, run)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintain(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		key  []byte
+	}{
+		{"plain", nil},
+		// Rebuilding the contentless index takes another path.
+		{"encrypted", testKey(1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newEncryptedDB(t, filepath.Join(t.TempDir(), "palace.db"), tc.key)
+			mustSave(t, db, testPage("https://a.com/", "Owls", "owls are birds"))
+
+			ops := maintenanceOpNames()
+			for _, op := range ops {
+				run, err := db.Maintain(op)
+				if err != nil {
+					t.Errorf("Maintain(%s): %v", op, err)
+				}
+				if run.ID == 0 || run.Op != op || !run.OK {
+					t.Errorf("Maintain(%s) = %+v", op, run)
+				}
+			}
+			if _, err := db.Maintain("defragment"); !errors.Is(err, ErrUnknownOp) {
+				t.Errorf("Maintain of an unknown op returned %v", err)
+			}
+
+			runs, err := db.MaintenanceRuns(100)
+			if err != nil {
+				t.Fatalf("MaintenanceRuns: %v", err)
+			}
+			if len(runs) != len(ops) {
+				t.Fatalf("got %d runs recorded, wanted %d", len(runs), len(ops))
+			}
+			for i, run := range runs {
+				// Newest first.
+				if want := ops[len(ops)-1-i]; run.Op != want || !run.OK || time.Since(run.StartedAt) > time.Minute {
+					t.Errorf("run %d = %+v, wanted a successful %s", i, run, want)
+				}
+			}
+
+			page, err := db.Search(SearchQuery{Query: "owls"})
+			if err != nil || len(page.Results) != 1 {
+				t.Errorf("after maintenance, search found %d pages: %v", len(page.Results), err)
+			}
+		})
+	}
+}
+
+func TestMaintainIntegrityCheck(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	id := mustSave(t, db, testPage("https://a.com/", "Owls", "owls are birds"))
+
+	// Changing the content behind the index's back leaves it out of date.
+	if _, err := db.Exec(`UPDATE web_data SET content = 'cats are not birds' WHERE id = ?`, id); err != nil {
+		t.Fatal(err)
+	}
+	run, err := db.Maintain("integrity-check")
+	if err == nil || run.OK || !strings.Contains(run.Detail, "index is corrupt") {
+		t.Errorf("integrity check of a corrupt index = %+v, %v", run, err)
+	}
+	if _, err := db.Maintain("rebuild"); err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if _, err := db.Maintain("integrity-check"); err != nil {
+		t.Errorf("integrity check after rebuilding: %v", err)
+	}
+
+	// Other errors are not blamed on the index.
+	db.Close()
+	if _, err := db.Maintain("integrity-check"); err == nil || strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("integrity check on a closed database returned %v", err)
+	}
+}
+
+func TestNextMaintenance(t *testing.T) {
+	at := func(day, hour, min, sec int) time.Time {
+		return time.Date(2024, 3, day, hour, min, sec, 0, time.UTC)
+	}
+	table := []struct {
+		now  time.Time
+		hour int
+		want time.Time
+	}{
+		{at(10, 2, 59, 59), 3, at(10, 3, 0, 0)},
+		{at(10, 3, 0, 0), 3, at(11, 3, 0, 0)},
+		{at(10, 3, 0, 1), 3, at(11, 3, 0, 0)},
+		{at(10, 23, 30, 0), 0, at(11, 0, 0, 0)},
+		{at(31, 23, 30, 0), 3, time.Date(2024, 4, 1, 3, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range table {
+		if got := nextMaintenance(tc.now, tc.hour); !got.Equal(tc.want) {
+			t.Errorf("nextMaintenance(%v, %d) = %v, wanted %v", tc.now, tc.hour, got, tc.want)
+		}
+	}
+}
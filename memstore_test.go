@@ -0,0 +1,198 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spencer-p/palace/pkg/prettytime"
+	"github.com/spencer-p/palace/pkg/shingle"
+)
+
+// MemStore is a Store that keeps pages in memory, for testing handlers without
+// a database. A page matches a search if it has every word of the query, and
+// pages with more of them, especially in the title, rank higher. There is no
+// stemming, no query syntax and no facets.
+type MemStore struct {
+	mu     sync.Mutex
+	nextID int64
+	// pages are in the order they were saved.
+	pages []memPage
+}
+
+type memPage struct {
+	id  int64
+	col DataColumn
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{nextID: 1}
+}
+
+func (m *MemStore) Save(col DataColumn) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.pages {
+		if p.col.URL == col.URL && p.col.SafeTitle == col.SafeTitle && p.col.SafeContent == col.SafeContent {
+			return 0, fmt.Errorf("page %d is already saved with the same content", p.id)
+		}
+	}
+	id := m.nextID
+	m.nextID++
+	m.pages = append(m.pages, memPage{id: id, col: col})
+
+	// Keep the newest five versions of the URL, like DB.Evict.
+	versions := 0
+	for i := len(m.pages) - 1; i >= 0; i-- {
+		if m.pages[i].col.URL != col.URL {
+			continue
+		}
+		if versions++; versions > 5 {
+			m.pages = slices.Delete(m.pages, i, i+1)
+		}
+	}
+	return id, nil
+}
+
+func (m *MemStore) Search(q SearchQuery) (SearchPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var terms []string
+	for _, field := range strings.Fields(q.Query) {
+		switch field {
+		case "AND", "OR", "NOT", "NEAR":
+			continue
+		}
+		for _, w := range shingle.Words(field) {
+			terms = append(terms, w.Text)
+		}
+	}
+	if len(terms) == 0 {
+		return SearchPage{}, nil
+	}
+
+	type scored struct {
+		p     memPage
+		score int
+	}
+	var matches []scored
+	for _, p := range m.pages {
+		if !q.matchesFilters(p.col) {
+			continue
+		}
+		title := countWords(string(p.col.SafeTitle))
+		content := countWords(string(p.col.SafeContent))
+		score := 0
+		for _, t := range terms {
+			if title[t] == 0 && content[t] == 0 {
+				score = 0
+				break
+			}
+			score += 10*title[t] + content[t]
+		}
+		if score > 0 {
+			matches = append(matches, scored{p, score})
+		}
+	}
+	slices.SortFunc(matches, func(a, b scored) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(b.p.id, a.p.id))
+	})
+
+	limit := pageSize(q.Limit)
+	start := min(q.Cursor.Offset, len(matches))
+	end := min(start+limit, len(matches))
+	page := SearchPage{Total: len(matches)}
+	if end < len(matches) {
+		page.Next = &Cursor{Offset: end}
+	}
+	if start > 0 {
+		page.Prev = &Cursor{Offset: max(0, start-limit)}
+	}
+	for _, s := range matches[start:end] {
+		r := memResult(s.p)
+		r.SafeBlurb = leadingWords(r.SafeContent, 40)
+		page.Results = append(page.Results, r)
+	}
+	return page, nil
+}
+
+// matchesFilters checks the site and month filters of q against a page.
+func (q SearchQuery) matchesFilters(col DataColumn) bool {
+	if q.Site != "" {
+		u, err := url.Parse(col.URL)
+		if err != nil || u.Host != q.Site {
+			return false
+		}
+	}
+	return q.Month == "" || col.ScrapedAt.Format("2006-01") == q.Month
+}
+
+// countWords counts the words in escaped text.
+func countWords(safe string) map[string]int {
+	counts := make(map[string]int)
+	for _, w := range shingle.Words(html.UnescapeString(safe)) {
+		counts[w.Text]++
+	}
+	return counts
+}
+
+func memResult(p memPage) SearchResult {
+	return SearchResult{
+		DataColumn: p.col,
+		ID:         int(p.id),
+		ScrapedAgo: prettytime.DurationBetween(time.Now(), p.col.ScrapedAt),
+	}
+}
+
+func (m *MemStore) Fetch(id int64) (SearchResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pages {
+		if p.id == id {
+			return memResult(p), nil
+		}
+	}
+	return SearchResult{}, ErrNotFound
+}
+
+func (m *MemStore) Delete(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pages = slices.DeleteFunc(m.pages, func(p memPage) bool { return p.id == id })
+	return nil
+}
+
+func (m *MemStore) History(from Cursor, limit int) (SearchPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limit = pageSize(limit)
+	var results []SearchResult
+	if from.Before {
+		for _, p := range m.pages {
+			if p.id > from.ID && len(results) <= limit {
+				results = append(results, memResult(p))
+			}
+		}
+	} else {
+		for i := len(m.pages) - 1; i >= 0; i-- {
+			p := m.pages[i]
+			if (from.IsZero() || p.id < from.ID) && len(results) <= limit {
+				results = append(results, memResult(p))
+			}
+		}
+	}
+
+	page := SearchPage{Total: len(m.pages)}
+	page.Results, page.Next, page.Prev = keysetPage(results, limit, from, func(r SearchResult) Cursor {
+		return Cursor{ID: int64(r.ID)}
+	})
+	return page, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// Migrations are numbered from 1 with no gaps, e.g. 0002_search_prefixes.sql.
+// The number of the last one applied is kept in PRAGMA user_version. Once
+// released, a migration must never change; add another one instead.
+//
+// Postgres has its own migrations in migrations/postgres, see PGStore.
+//
+//go:embed migrations/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+func (m migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// loadMigrations reads the migrations in a directory of migrationFiles.
+func loadMigrations(dir string) ([]migration, error) {
+	// Glob sorts by name, and the names start with zero padded numbers.
+	names, err := fs.Glob(migrationFiles, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, len(names))
+	for i, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		num, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %q is not named like 0001_name.sql", name)
+		}
+		if version != i+1 {
+			return nil, fmt.Errorf("migration %q should be number %d", name, i+1)
+		}
+		sql, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		migrations[i] = migration{Version: version, Name: label, SQL: string(sql)}
+	}
+	return migrations, nil
+}
+
+// SchemaVersion is the number of the last migration applied to the database.
+func (db *DB) SchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	return version, err
+}
+
+// PendingMigrations lists the migrations that haven't been applied yet. It
+// fails if the database was migrated by a newer version of Palace, since this
+// one doesn't know what changed.
+func (db *DB) PendingMigrations() ([]migration, error) {
+	return pendingMigrations(db, "migrations")
+}
+
+func pendingMigrations(db interface{ SchemaVersion() (int, error) }, dir string) ([]migration, error) {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("database schema is at version %d but this build only knows up to %d, refusing to touch it",
+			version, len(migrations))
+	}
+	return migrations[version:], nil
+}
+
+// Migrate applies each pending migration in its own transaction, so a failed
+// migration leaves the database as the previous one did.
+func (db *DB) Migrate() error {
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err := db.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %s: %w", m, err)
+		}
+		log.Infof("Applied migration %s", m)
+	}
+	return nil
+}
+
+func (db *DB) applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	// Pragmas can't take parameters.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.Version)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	return tx.Commit()
+}
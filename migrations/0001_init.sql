@@ -1,3 +1,5 @@
+-- The schema from before migrations were tracked. Databases created back then
+-- are at version 0 but already have all of this.
 CREATE TABLE IF NOT EXISTS web_data
 	( id INTEGER PRIMARY KEY AUTOINCREMENT
 	, url TEXT NOT NULL
@@ -23,11 +25,3 @@ END;
 CREATE TRIGGER IF NOT EXISTS wd_ad AFTER DELETE ON web_data BEGIN
 	INSERT INTO search_index(search_index, rowid, content, title) VALUES('delete', old.id, old.content, old.title);
 END;
-
--- https://kerkour.com/sqlite-for-servers
-PRAGMA journal_mode = WAL;
-PRAGMA busy_timeout = 30000; -- 30s.
-PRAGMA synchronous = NORMAL;
-PRAGMA cache_size = 1000000000; -- 1e9 pages.
-PRAGMA foreign_keys = true;
-PRAGMA temp_store = memory;
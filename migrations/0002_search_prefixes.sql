@@ -0,0 +1,17 @@
+-- Prefix indexes make completing a partly typed word cheap. FTS5 options can't
+-- be changed after the fact, so the index is rebuilt from web_data.
+DROP TABLE IF EXISTS search_index;
+
+CREATE VIRTUAL TABLE search_index USING fts5
+	( content = 'web_data'
+	, content_rowid = 'id'
+	, tokenize = 'porter unicode61'
+	, prefix = '2 3'
+	, content
+	, title
+);
+
+INSERT INTO search_index(search_index) VALUES ('rebuild');
+
+-- Exposes the indexed terms, used to correct misspelled queries.
+CREATE VIRTUAL TABLE IF NOT EXISTS search_vocab USING fts5vocab(search_index, row);
@@ -0,0 +1,13 @@
+-- Vectors for hybrid search, one per chunk of each page. The model column names
+-- the embedder so that its vectors can be replaced if it changes.
+CREATE TABLE IF NOT EXISTS chunk_vectors
+	( page_id INTEGER NOT NULL
+	, chunk INTEGER NOT NULL
+	, model TEXT NOT NULL
+	, vector BLOB NOT NULL
+	, PRIMARY KEY (page_id, chunk)
+);
+
+CREATE TRIGGER IF NOT EXISTS wd_ad_vectors AFTER DELETE ON web_data BEGIN
+	DELETE FROM chunk_vectors WHERE page_id = old.id;
+END;
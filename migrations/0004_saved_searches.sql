@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS saved_searches
+	( id INTEGER PRIMARY KEY AUTOINCREMENT
+	, name TEXT NOT NULL
+	, query TEXT NOT NULL
+	, webhook TEXT NOT NULL DEFAULT ''
+	, created_at TIME NOT NULL
+);
+
+-- Alerts copy the page's URL and title so that they outlive eviction.
+CREATE TABLE IF NOT EXISTS search_alerts
+	( id INTEGER PRIMARY KEY AUTOINCREMENT
+	, search_id INTEGER NOT NULL
+	, page_id INTEGER NOT NULL
+	, url TEXT NOT NULL
+	, title TEXT NOT NULL
+	, matched_at TIME NOT NULL
+	, seen BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX IF NOT EXISTS search_alerts_url ON search_alerts(search_id, url);
+
+CREATE TRIGGER IF NOT EXISTS ss_ad AFTER DELETE ON saved_searches BEGIN
+	DELETE FROM search_alerts WHERE search_id = old.id;
+END;
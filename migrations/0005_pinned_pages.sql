@@ -0,0 +1,2 @@
+-- Pinned pages are spared by retention rules and eviction.
+ALTER TABLE web_data ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,10 @@
+-- Rules for how many versions of a URL to keep, see VersionRule.
+CREATE TABLE IF NOT EXISTS version_rules
+	( id INTEGER PRIMARY KEY AUTOINCREMENT
+	, pattern TEXT NOT NULL UNIQUE
+	, keep INTEGER NOT NULL
+	, created_at TIME NOT NULL
+);
+
+-- Eviction looks up every version of a URL.
+CREATE INDEX IF NOT EXISTS web_data_url ON web_data(url, id);
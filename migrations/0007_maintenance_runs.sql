@@ -0,0 +1,9 @@
+-- Results of index and database maintenance, see maintenanceOps.
+CREATE TABLE IF NOT EXISTS maintenance_runs
+	( id INTEGER PRIMARY KEY AUTOINCREMENT
+	, op TEXT NOT NULL
+	, started_at TIME NOT NULL
+	, took_ms INTEGER NOT NULL
+	, ok BOOLEAN NOT NULL
+	, detail TEXT NOT NULL DEFAULT ''
+);
@@ -0,0 +1,6 @@
+-- Encrypted pages are sealed with a random nonce, so web_data_uniq can't spot
+-- a page saved twice. They carry a keyed digest of the page instead, see
+-- ApplyKeys. Pages stored in the clear leave it NULL.
+ALTER TABLE web_data ADD COLUMN digest BLOB;
+
+CREATE UNIQUE INDEX web_data_digest ON web_data(digest) WHERE digest IS NOT NULL;
@@ -0,0 +1,7 @@
+-- Running totals of the pages deleted to make room, by why: "versions" for
+-- versions beyond what a URL keeps, "retention" for retention rules.
+CREATE TABLE IF NOT EXISTS evictions
+	( reason TEXT PRIMARY KEY
+	, pages INTEGER NOT NULL
+	, last_at TIME NOT NULL
+);
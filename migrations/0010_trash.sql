@@ -0,0 +1,5 @@
+-- Deleted pages go to the trash first, where they can be restored until they
+-- are purged. Pages not in the trash leave deleted_at NULL.
+ALTER TABLE web_data ADD COLUMN deleted_at TIME;
+
+CREATE INDEX web_data_deleted ON web_data(deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,3 @@
+-- Exposes where each term was indexed. The vocabulary holds porter stems, so
+-- completions look up a word that was stemmed to the term to show instead.
+CREATE VIRTUAL TABLE IF NOT EXISTS search_instances USING fts5vocab(search_index, instance);
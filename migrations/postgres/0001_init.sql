@@ -0,0 +1,25 @@
+-- Postgres has no user_version, so applied migrations are recorded here.
+CREATE TABLE schema_migrations
+	( version INTEGER PRIMARY KEY
+	, applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Titles and content are stored HTML escaped, as in SQLite.
+CREATE TABLE web_data
+	( id BIGSERIAL PRIMARY KEY
+	, url TEXT NOT NULL
+	, scraped_at TIMESTAMPTZ NOT NULL
+	, content TEXT NOT NULL
+	, title TEXT NOT NULL
+	-- Weight A for the title and D for the content, so that ts_rank can weigh
+	-- them like the bm25 column weights.
+	, search TSVECTOR GENERATED ALWAYS AS
+		( setweight(to_tsvector('english', title), 'A')
+		|| setweight(to_tsvector('english', content), 'D')
+		) STORED
+);
+
+-- Content can be too long for a btree, so only its hash is indexed.
+CREATE UNIQUE INDEX web_data_uniq ON web_data (md5(content), title, url);
+CREATE INDEX web_data_url ON web_data (url, id);
+CREATE INDEX web_data_search ON web_data USING GIN (search);
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/charmbracelet/log"
+)
+
+// publicURL is where browsers reach Palace, e.g. https://example.com/palace.
+// If unset it is guessed from each request.
+var publicURL = os.Getenv("PUBLIC_URL")
+
+// baseURL is the absolute URL of the root of the site, which OpenSearch needs
+// since its documents are fetched and used out of context.
+func baseURL(r *http.Request) string {
+	if publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = fwd
+	}
+	u := url.URL{Scheme: scheme, Host: host, Path: prefix}
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+// makeOpenSearch serves the OpenSearch description that lets browsers add
+// Palace as a search engine. It is public, browsers fetch it without asking.
+func makeOpenSearch() func(w http.ResponseWriter, r *http.Request) {
+	descTemplate := template.Must(template.ParseFS(staticContent, "static/opensearch.template.xml"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+		w.WriteHeader(http.StatusOK)
+		if err := descTemplate.Execute(w, map[string]any{
+			"Base": baseURL(r),
+		}); err != nil {
+			log.Errorf("failed to render opensearch description: %v", err)
+		}
+	}
+}
+
+// makeOpenSearchSuggest serves suggestions in the OpenSearch JSON format: the
+// query, then completions, descriptions and URLs as parallel arrays.
+func makeOpenSearchSuggest(store Suggester) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.FormValue("q")
+		sugg, err := store.Suggest(query, 8)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("opensearch suggest: failed to query for %q: %v", query, err)
+			return
+		}
+
+		base := baseURL(r)
+		var completions, descriptions, urls []string
+		for _, c := range sugg.Completions {
+			completions = append(completions, c)
+			descriptions = append(descriptions, "")
+			urls = append(urls, base+"/search?q="+url.QueryEscape(c))
+		}
+		for _, p := range sugg.Pages {
+			completions = append(completions, p.Title)
+			descriptions = append(descriptions, p.URL)
+			urls = append(urls, p.URL)
+		}
+
+		w.Header().Set("Content-Type", "application/x-suggestions+json")
+		writeJSON(w, []any{query, nonNil(completions), nonNil(descriptions), nonNil(urls)})
+	}
+}
+
+// nonNil makes sure empty lists are encoded as [] rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+const maxPageSize = 500
+
+// defaultPageSize is the number of results on a page unless the request asks
+// for another size.
+var defaultPageSize = envInt("PAGE_SIZE", 50)
+
+// Cursor marks a position in an ordered list of results, so that the next
+// page can pick up where the last left off instead of counting rows with
+// OFFSET. It is passed around as an opaque string.
+type Cursor struct {
+	// Rank and ID are the sort key of the row the cursor points at.
+	Rank float64 `json:"r,omitempty"`
+	ID   int64   `json:"i,omitempty"`
+	// Offset is used instead for rankings that aren't computed in SQL.
+	Offset int `json:"o,omitempty"`
+	// Before points at the page before the row rather than after it.
+	Before bool `json:"b,omitempty"`
+}
+
+// IsZero reports whether c points at the start of the results.
+func (c Cursor) IsZero() bool {
+	return c == Cursor{}
+}
+
+func (c Cursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor decodes a cursor made by Cursor.String. The empty string is the
+// start of the results.
+func ParseCursor(s string) (Cursor, error) {
+	var c Cursor
+	if s == "" {
+		return c, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("bad cursor: %w", err)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("bad cursor: %w", err)
+	}
+	return c, nil
+}
+
+// pageSize clamps a requested page size, using the default if none was asked
+// for.
+func pageSize(limit int) int {
+	if limit <= 0 {
+		return defaultPageSize
+	}
+	return min(limit, maxPageSize)
+}
+
+// keysetPage finishes a page read with a keyset query. The query should have
+// fetched up to limit+1 rows in the direction of the cursor so that we can tell
+// whether there are more. It returns the rows in display order and cursors for
+// the neighbouring pages, which are nil if there is nothing there.
+func keysetPage[T any](rows []T, limit int, from Cursor, cursorOf func(T) Cursor) ([]T, *Cursor, *Cursor) {
+	more := len(rows) > limit
+	if more {
+		rows = rows[:limit]
+	}
+	if from.Before {
+		slices.Reverse(rows)
+	}
+	if len(rows) == 0 {
+		return rows, nil, nil
+	}
+
+	var next, prev *Cursor
+	// Going backwards, we came from the page after.
+	if more || from.Before {
+		c := cursorOf(rows[len(rows)-1])
+		next = &c
+	}
+	// Going forwards, we came from the page before.
+	if (from.Before && more) || (!from.Before && !from.IsZero()) {
+		c := cursorOf(rows[0])
+		c.Before = true
+		prev = &c
+	}
+	return rows, next, prev
+}
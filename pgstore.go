@@ -0,0 +1,417 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/prettytime"
+)
+
+// PGStore keeps pages in PostgreSQL, for deployments shared by a team. It
+// searches with tsvector and ranks with ts_rank. The features in SQLite's DB
+// that lean on FTS5 internals, like spelling and quote search, are not
+// offered.
+type PGStore struct {
+	*sql.DB
+
+	// Weights are relative weights of matches in each column, as in DB.
+	Weights ColumnWeights
+}
+
+var _ Store = (*PGStore)(nil)
+
+// NewPGStore connects to the database at url and brings its schema up to
+// date.
+func NewPGStore(url string) (*PGStore, error) {
+	pg, err := OpenPGStore(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := pg.Migrate(); err != nil {
+		pg.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	return pg, nil
+}
+
+// OpenPGStore connects to the database at url without touching its schema.
+func OpenPGStore(url string) (*PGStore, error) {
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+	return &PGStore{DB: db, Weights: DefaultWeights}, nil
+}
+
+// SchemaVersion is the number of the last migration applied to the database.
+func (pg *PGStore) SchemaVersion() (int, error) {
+	var exists bool
+	if err := pg.QueryRow(`SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	err := pg.QueryRow(`SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// PendingMigrations lists the migrations that haven't been applied yet, see
+// DB.PendingMigrations.
+func (pg *PGStore) PendingMigrations() ([]migration, error) {
+	return pendingMigrations(pg, "migrations/postgres")
+}
+
+// Migrate applies each pending migration in its own transaction.
+func (pg *PGStore) Migrate() error {
+	pending, err := pg.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err := pg.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %s: %w", m, err)
+		}
+		log.Infof("Applied migration %s", m)
+	}
+	return nil
+}
+
+func (pg *PGStore) applyMigration(m migration) error {
+	tx, err := pg.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations(version) VALUES ($1)`, m.Version); err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+	return tx.Commit()
+}
+
+// pgArgs numbers query arguments as they are added, since Postgres
+// placeholders are $1, $2 and so on rather than ?.
+type pgArgs []any
+
+func (a *pgArgs) add(v any) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// pgHostExpr and pgMonthExpr are hostExpr and monthExpr for Postgres.
+const (
+	pgHostExpr  = `substring(url from '://([^/]*)')`
+	pgMonthExpr = `to_char(scraped_at, 'YYYY-MM')`
+)
+
+// headlineOptions make ts_headline snippets look like FTS5's.
+const headlineOptions = `StartSel=<b>, StopSel=</b>, MinWords=20, MaxWords=40, MaxFragments=2, FragmentDelimiter=...`
+
+func (pg *PGStore) Save(col DataColumn) (int64, error) {
+	var id int64
+	err := pg.QueryRow(`INSERT INTO web_data(url, scraped_at, title, content) VALUES ($1, $2, $3, $4) RETURNING id`,
+		col.URL, col.ScrapedAt, string(col.SafeTitle), string(col.SafeContent),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	// Keep the newest five versions of the URL, like DB.Evict.
+	result, err := pg.Exec(`
+	DELETE FROM web_data
+	WHERE url = $1 AND id NOT IN (
+		SELECT id FROM web_data WHERE url = $1 ORDER BY id DESC LIMIT 5
+	)`, col.URL)
+	if err != nil {
+		log.Warnf("failed to evict old entries for %q: %v", col.URL, err)
+	} else if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+		log.Infof("Dropped %d rows for %q", affected, col.URL)
+	}
+	return id, nil
+}
+
+// pgWhere builds the conditions of a search on the tsquery named query.
+func (q SearchQuery) pgWhere(args *pgArgs) string {
+	clause := `search @@ query`
+	if q.Site != "" {
+		clause += ` AND ` + pgHostExpr + ` = ` + args.add(q.Site)
+	}
+	if q.Month != "" {
+		clause += ` AND ` + pgMonthExpr + ` = ` + args.add(q.Month)
+	}
+	return clause
+}
+
+// rankWeights formats the column weights for ts_rank, which takes weights for
+// D, C, B and A between 0 and 1.
+func (pg *PGStore) rankWeights() string {
+	scale := max(pg.Weights.Content, pg.Weights.Title)
+	if scale <= 0 {
+		scale = 1
+	}
+	return fmt.Sprintf("{%g,0,0,%g}", pg.Weights.Content/scale, pg.Weights.Title/scale)
+}
+
+// Search ranks matches like DB's keyword search. Scores are negated so that
+// lower is better, as with bm25, and the keyset conditions are the same.
+func (pg *PGStore) Search(q SearchQuery) (SearchPage, error) {
+	limit := pageSize(q.Limit)
+	var args pgArgs
+	query := args.add(q.Query)
+	weights := args.add(pg.rankWeights())
+	where := q.pgWhere(&args)
+	keyset, order := `true`, `score, id`
+	switch {
+	case q.Cursor.Before:
+		rank, id := args.add(q.Cursor.Rank), args.add(q.Cursor.ID)
+		keyset = `score < ` + rank + ` OR (score = ` + rank + ` AND id < ` + id + `)`
+		order = `score DESC, id DESC`
+	case !q.Cursor.IsZero():
+		rank, id := args.add(q.Cursor.Rank), args.add(q.Cursor.ID)
+		keyset = `score > ` + rank + ` OR (score = ` + rank + ` AND id > ` + id + `)`
+	}
+
+	rows, err := pg.Query(`
+	SELECT id, score FROM (
+		SELECT id, -ts_rank(`+weights+`::float4[], search, query)::float8 AS score
+		FROM web_data, websearch_to_tsquery('english', `+query+`) query
+		WHERE `+where+`
+	) ranked
+	WHERE `+keyset+`
+	ORDER BY `+order+`
+	LIMIT `+args.add(limit+1),
+		args...,
+	)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	defer rows.Close()
+
+	var ranked []Cursor
+	for rows.Next() {
+		var c Cursor
+		if err := rows.Scan(&c.ID, &c.Rank); err != nil {
+			return SearchPage{}, fmt.Errorf("column %d: scan: %w", len(ranked), err)
+		}
+		ranked = append(ranked, c)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchPage{}, err
+	}
+
+	var page SearchPage
+	ranked, page.Next, page.Prev = keysetPage(ranked, limit, q.Cursor, func(c Cursor) Cursor { return c })
+	ids := make([]int64, len(ranked))
+	for i, c := range ranked {
+		ids[i] = c.ID
+	}
+	page.Results, err = pg.resultsByID(q.Query, ids)
+	if err != nil {
+		return SearchPage{}, err
+	}
+
+	var countArgs pgArgs
+	countQuery := countArgs.add(q.Query)
+	err = pg.QueryRow(`
+	SELECT count(*)
+	FROM web_data, websearch_to_tsquery('english', `+countQuery+`) query
+	WHERE `+q.pgWhere(&countArgs), countArgs...).Scan(&page.Total)
+	if err != nil {
+		return SearchPage{}, fmt.Errorf("count: %w", err)
+	}
+
+	if q.WithFacets {
+		facets, err := pg.facets(q)
+		if err != nil {
+			return SearchPage{}, fmt.Errorf("facets: %w", err)
+		}
+		page.Facets = &facets
+	}
+	return page, nil
+}
+
+// resultsByID loads search results with snippets in the given order, see
+// DB.resultsByID.
+func (pg *PGStore) resultsByID(query string, ids []int64) ([]SearchResult, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	rows, err := pg.Query(`
+	SELECT
+		id, url, scraped_at, title, content,
+		ts_headline('english', content, query, $3),
+		ts_headline('english', title, query, $3)
+	FROM web_data, websearch_to_tsquery('english', $1) query
+	WHERE id = ANY($2)`,
+		query, ids, headlineOptions,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int64]SearchResult)
+	for rows.Next() {
+		var r SearchResult
+		var blurb, titleBlurb template.HTML
+		var scrapedAt time.Time
+		if err := rows.Scan(&r.ID, &r.URL, &scrapedAt, &r.SafeTitle, &r.SafeContent, &blurb, &titleBlurb); err != nil {
+			return nil, fmt.Errorf("column %d: scan: %w", len(byID), err)
+		}
+		pgResultTimes(&r, scrapedAt)
+		// If only the title matched, show where it matched instead.
+		if !strings.Contains(string(blurb), "<b>") && strings.Contains(string(titleBlurb), "<b>") {
+			blurb = titleBlurb
+		}
+		r.SafeBlurb = blurb
+		byID[int64(r.ID)] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, 0, len(ids))
+	for _, id := range ids {
+		if r, ok := byID[id]; ok {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+func (pg *PGStore) facets(q SearchQuery) (Facets, error) {
+	var f Facets
+	var err error
+	f.Sites, err = pg.facetCounts(q, pgHostExpr, `count(*) DESC, value`, maxSiteFacets)
+	if err != nil {
+		return f, fmt.Errorf("sites: %w", err)
+	}
+	f.Months, err = pg.facetCounts(q, pgMonthExpr, `value DESC`, maxMonthFacets)
+	if err != nil {
+		return f, fmt.Errorf("months: %w", err)
+	}
+	return f, nil
+}
+
+func (pg *PGStore) facetCounts(q SearchQuery, expr, order string, limit int) ([]FacetCount, error) {
+	var args pgArgs
+	query := args.add(q.Query)
+	where := q.pgWhere(&args)
+	rows, err := pg.Query(`
+	SELECT `+expr+` AS value, count(*)
+	FROM web_data, websearch_to_tsquery('english', `+query+`) query
+	WHERE `+where+`
+	GROUP BY value
+	ORDER BY `+order+`
+	LIMIT `+args.add(limit),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []FacetCount{}
+	for rows.Next() {
+		var c FacetCount
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// pgResultTimes fills in the scrape time of a result in local time, as
+// timeFromDB does for SQLite.
+func pgResultTimes(r *SearchResult, scrapedAt time.Time) {
+	r.ScrapedAt = scrapedAt.Local()
+	r.ScrapedAgo = prettytime.DurationBetween(time.Now(), r.ScrapedAt)
+}
+
+func (pg *PGStore) Fetch(id int64) (SearchResult, error) {
+	r := SearchResult{ID: int(id)}
+	var scrapedAt time.Time
+	err := pg.QueryRow(`SELECT url, scraped_at, title, content FROM web_data WHERE id = $1`, id).
+		Scan(&r.URL, &scrapedAt, &r.SafeTitle, &r.SafeContent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SearchResult{}, ErrNotFound
+	}
+	if err != nil {
+		return SearchResult{}, fmt.Errorf("scan: %w", err)
+	}
+	pgResultTimes(&r, scrapedAt)
+	return r, nil
+}
+
+func (pg *PGStore) Delete(id int64) error {
+	if _, err := pg.Exec(`DELETE FROM web_data WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete: %v", err)
+	}
+	return nil
+}
+
+func (pg *PGStore) History(from Cursor, limit int) (SearchPage, error) {
+	limit = pageSize(limit)
+	keyset, order := `true`, `id DESC`
+	var args pgArgs
+	switch {
+	case from.Before:
+		keyset, order = `id > `+args.add(from.ID), `id`
+	case !from.IsZero():
+		keyset = `id < ` + args.add(from.ID)
+	}
+
+	rows, err := pg.Query(`
+	SELECT id, url, scraped_at, title, content
+	FROM web_data
+	WHERE `+keyset+`
+	ORDER BY `+order+`
+	LIMIT `+args.add(limit+1),
+		args...,
+	)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		var scrapedAt time.Time
+		if err := rows.Scan(&r.ID, &r.URL, &scrapedAt, &r.SafeTitle, &r.SafeContent); err != nil {
+			return SearchPage{}, fmt.Errorf("column %d: scan: %w", len(results), err)
+		}
+		pgResultTimes(&r, scrapedAt)
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchPage{}, err
+	}
+
+	var page SearchPage
+	page.Results, page.Next, page.Prev = keysetPage(results, limit, from, func(r SearchResult) Cursor {
+		return Cursor{ID: int64(r.ID)}
+	})
+	if err := pg.QueryRow(`SELECT count(*) FROM web_data`).Scan(&page.Total); err != nil {
+		return SearchPage{}, fmt.Errorf("count: %w", err)
+	}
+	return page, nil
+}
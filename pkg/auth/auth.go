@@ -35,7 +35,6 @@ const (
 )
 
 func init() {
-	setupCookiesOrDie()
 	gob.Register(authToken{})
 	gob.Register(time.Time{})
 }
@@ -52,7 +51,9 @@ type authToken struct {
 	CreationTimestamp time.Time
 }
 
-func setupCookiesOrDie() {
+// Setup reads the keys from the environment. It must be called before anything
+// else in the package, and panics if the keys are missing or invalid.
+func Setup() {
 	salt = MustDecodeBase64([]byte(os.Getenv("AUTH_SALT")))
 	if len(salt) == 0 {
 		panic(fmt.Errorf("AUTH_SALT must be non-empty"))
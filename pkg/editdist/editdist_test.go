@@ -0,0 +1,31 @@
+package editdist
+
+import "testing"
+
+func TestLevenshtein(t *testing.T) {
+	table := []struct {
+		a, b string
+		want int
+	}{{
+		a: "", b: "", want: 0,
+	}, {
+		a: "kitten", b: "kitten", want: 0,
+	}, {
+		a: "", b: "abc", want: 3,
+	}, {
+		a: "kitten", b: "sitting", want: 3,
+	}, {
+		a: "kuberntes", b: "kubernetes", want: 1,
+	}, {
+		a: "café", b: "cafe", want: 1,
+	}}
+
+	for _, tc := range table {
+		t.Run(tc.a+"->"+tc.b, func(t *testing.T) {
+			if got := Levenshtein(tc.a, tc.b); got != tc.want {
+				t.Errorf("Levenshtein(%q, %q) returned %d, wanted %d",
+					tc.a, tc.b, got, tc.want)
+			}
+		})
+	}
+}
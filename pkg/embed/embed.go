@@ -0,0 +1,156 @@
+// Package embed turns text into vectors so that pages can be compared by
+// meaning rather than exact words.
+package embed
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Embedder turns text into a fixed length, unit length vector. Texts about
+// similar things should have vectors with a high dot product.
+type Embedder interface {
+	// Name identifies the embedder and its settings. Vectors from embedders
+	// with different names are not comparable.
+	Name() string
+	Embed(text string) []float32
+}
+
+// Hashed embeds text by hashing its words, word pairs and character trigrams
+// into a fixed number of dimensions. It needs no model and runs anywhere, but
+// only knows that words are related if they are spelled alike.
+type Hashed struct {
+	dims int
+}
+
+// NewHashed creates a hashed embedder producing vectors of dims dimensions.
+func NewHashed(dims int) *Hashed {
+	return &Hashed{dims: dims}
+}
+
+func (h *Hashed) Name() string {
+	return fmt.Sprintf("hashed-%d", h.dims)
+}
+
+func (h *Hashed) Embed(text string) []float32 {
+	v := make([]float32, h.dims)
+	words := Words(text)
+	for i, w := range words {
+		h.add(v, w, 1)
+		if i > 0 {
+			h.add(v, words[i-1]+" "+w, 0.5)
+		}
+		// Trigrams let "running" and "runner" share some weight.
+		padded := []rune(" " + w + " ")
+		for j := 0; j+3 <= len(padded); j++ {
+			h.add(v, string(padded[j:j+3]), 0.25)
+		}
+	}
+	return Normalize(v)
+}
+
+// add hashes feature into a dimension and a sign, so that collisions tend to
+// cancel out rather than pile up.
+func (h *Hashed) add(v []float32, feature string, weight float32) {
+	f := fnv.New64a()
+	f.Write([]byte(feature))
+	sum := f.Sum64()
+	if sum&1 == 1 {
+		weight = -weight
+	}
+	v[(sum>>1)%uint64(len(v))] += weight
+}
+
+// Normalize scales v to unit length in place. A zero vector is left alone.
+func Normalize(v []float32) []float32 {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	if norm == 0 {
+		return v
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range v {
+		v[i] *= scale
+	}
+	return v
+}
+
+// Words splits text into lowercase words, dropping very short and very common
+// ones.
+func Words(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	words := fields[:0]
+	for _, w := range fields {
+		if len(w) < 3 || stopwords[w] {
+			continue
+		}
+		words = append(words, w)
+	}
+	return words
+}
+
+var stopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true,
+	"not": true, "you": true, "all": true, "any": true, "can": true,
+	"had": true, "her": true, "was": true, "one": true, "our": true,
+	"out": true, "has": true, "have": true, "this": true, "that": true,
+	"with": true, "from": true, "they": true, "will": true, "would": true,
+	"there": true, "their": true, "what": true, "about": true, "which": true,
+	"when": true, "were": true, "been": true, "into": true, "than": true,
+	"then": true, "them": true, "these": true, "some": true, "also": true,
+	"more": true, "its": true, "his": true, "she": true, "who": true,
+}
+
+// Chunks splits text into overlapping runs of about size words, so that a
+// long page gets one vector per section rather than one blurry vector.
+func Chunks(text string, size, overlap int) []string {
+	fields := strings.Fields(text)
+	if len(fields) <= size {
+		return []string{text}
+	}
+	var chunks []string
+	for start := 0; start < len(fields); start += size - overlap {
+		end := min(start+size, len(fields))
+		chunks = append(chunks, strings.Join(fields[start:end], " "))
+		if end == len(fields) {
+			break
+		}
+	}
+	return chunks
+}
+
+// Dot returns the dot product of two vectors, which is their cosine
+// similarity if both are unit length.
+func Dot(a, b []float32) float32 {
+	var sum float32
+	for i := range min(len(a), len(b)) {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// Encode packs a vector for storage.
+func Encode(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(x))
+	}
+	return b
+}
+
+// Decode unpacks a vector packed by Encode.
+func Decode(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
@@ -0,0 +1,54 @@
+package embed
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHashedSimilarity(t *testing.T) {
+	e := NewHashed(256)
+	query := e.Embed("running a kubernetes cluster")
+	near := e.Embed("How to run Kubernetes clusters in production")
+	far := e.Embed("A recipe for chocolate chip cookies")
+
+	if got := Dot(query, query); got < 0.999 || got > 1.001 {
+		t.Errorf("Dot(v, v) = %f, wanted unit length", got)
+	}
+	if Dot(query, near) <= Dot(query, far) {
+		t.Errorf("related text scored %f, unrelated text scored %f",
+			Dot(query, near), Dot(query, far))
+	}
+}
+
+func TestChunks(t *testing.T) {
+	table := []struct {
+		text          string
+		size, overlap int
+		want          []string
+	}{{
+		text: "a b c", size: 5, overlap: 1,
+		want: []string{"a b c"},
+	}, {
+		text: "a b c d e", size: 3, overlap: 1,
+		want: []string{"a b c", "c d e"},
+	}, {
+		text: "a b c d e f", size: 3, overlap: 1,
+		want: []string{"a b c", "c d e", "e f"},
+	}}
+
+	for _, tc := range table {
+		t.Run(tc.text, func(t *testing.T) {
+			if got := Chunks(tc.text, tc.size, tc.overlap); !slices.Equal(got, tc.want) {
+				t.Errorf("Chunks(%q, %d, %d) returned %q, wanted %q",
+					tc.text, tc.size, tc.overlap, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	v := []float32{0, 1, -0.5, 3.25}
+	if got := Decode(Encode(v)); !slices.Equal(got, v) {
+		t.Errorf("Decode(Encode(%v)) returned %v", v, got)
+	}
+}
@@ -0,0 +1,153 @@
+// Package keyring encrypts short values with AES-GCM under the current one of
+// a set of keys, and opens values sealed under any of them, so that keys can
+// be rotated without losing what the old ones sealed.
+//
+// A sealed value is a version byte, the ID of the key that sealed it, a random
+// nonce and the ciphertext. A key's ID is the start of its SHA-256 hash.
+package keyring
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	version   = 1
+	idSize    = 4
+	nonceSize = 12
+	// Overhead is how much longer a sealed value is than its plaintext.
+	Overhead = 1 + idSize + nonceSize + 16
+)
+
+var (
+	// ErrUnknownKey is returned by Open for values sealed under a key that
+	// isn't in the keyring.
+	ErrUnknownKey = errors.New("sealed with a key that isn't in the keyring")
+	// ErrCorrupt is returned by Open for values that were changed or aren't
+	// sealed at all.
+	ErrCorrupt = errors.New("sealed value is corrupt")
+)
+
+type key struct {
+	id   []byte
+	aead cipher.AEAD
+	// mac keys digests, so that they can't be checked against guessed
+	// plaintexts without the key.
+	mac []byte
+}
+
+func newKey(secret []byte) (*key, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(secret)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("keyring digest"))
+	return &key{id: sum[:idSize], aead: aead, mac: mac.Sum(nil)}, nil
+}
+
+// Keyring holds the keys values may be sealed under.
+type Keyring struct {
+	current *key
+	keys    []*key
+}
+
+// New makes a keyring that seals under current and opens values sealed under
+// current or any of the old keys. Keys must be 16, 24 or 32 bytes. Current may
+// be nil to only open values, for example to decrypt everything.
+func New(current []byte, old ...[]byte) (*Keyring, error) {
+	k := &Keyring{}
+	if current != nil {
+		c, err := newKey(current)
+		if err != nil {
+			return nil, fmt.Errorf("current key: %w", err)
+		}
+		k.current = c
+		k.keys = append(k.keys, c)
+	}
+	for i, secret := range old {
+		o, err := newKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("old key %d: %w", i+1, err)
+		}
+		k.keys = append(k.keys, o)
+	}
+	return k, nil
+}
+
+// Sealing reports whether the keyring has a current key to seal with.
+func (k *Keyring) Sealing() bool {
+	return k.current != nil
+}
+
+// CurrentID is the ID that values sealed by the current key start with, after
+// the version byte. It is nil if there is no current key.
+func (k *Keyring) CurrentID() []byte {
+	if k.current == nil {
+		return nil
+	}
+	return bytes.Clone(k.current.id)
+}
+
+// Seal encrypts plaintext under the current key, authenticating additional
+// data with it. It panics if there is no current key.
+func (k *Keyring) Seal(plaintext, additionalData []byte) []byte {
+	if k.current == nil {
+		panic("keyring: Seal without a current key")
+	}
+	sealed := make([]byte, 1+idSize+nonceSize, Overhead+len(plaintext))
+	sealed[0] = version
+	copy(sealed[1:], k.current.id)
+	nonce := sealed[1+idSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("keyring: no randomness for a nonce: %v", err))
+	}
+	return k.current.aead.Seal(sealed, nonce, plaintext, additionalData)
+}
+
+// Open decrypts a value sealed under any key in the keyring with the same
+// additional data.
+func (k *Keyring) Open(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < Overhead || sealed[0] != version {
+		return nil, ErrCorrupt
+	}
+	id := sealed[1 : 1+idSize]
+	nonce := sealed[1+idSize : 1+idSize+nonceSize]
+	for _, key := range k.keys {
+		if !bytes.Equal(key.id, id) {
+			continue
+		}
+		plaintext, err := key.aead.Open(nil, nonce, sealed[1+idSize+nonceSize:], additionalData)
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		return plaintext, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// Digest is a keyed hash of the parts under the current key, for finding
+// duplicates without storing plaintext. It is nil if there is no current key.
+func (k *Keyring) Digest(parts ...[]byte) []byte {
+	if k.current == nil {
+		return nil
+	}
+	h := hmac.New(sha256.New, k.current.mac)
+	for _, p := range parts {
+		// Length prefixes keep ("ab", "c") and ("a", "bc") apart.
+		h.Write([]byte(fmt.Sprintf("%d:", len(p))))
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,80 @@
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	otherKey := bytes.Repeat([]byte{3}, 32)
+
+	before := mustNew(t, oldKey)
+	rotated := mustNew(t, newKey, oldKey)
+	openOnly := mustNew(t, nil, newKey, oldKey)
+	other := mustNew(t, otherKey)
+
+	sealedBefore := before.Seal([]byte("tom & jerry"), []byte("title"))
+	sealedAfter := rotated.Seal([]byte("tom & jerry"), []byte("title"))
+	changed := bytes.Clone(sealedAfter)
+	changed[len(changed)-1] ^= 1
+
+	table := []struct {
+		name    string
+		keys    *Keyring
+		sealed  []byte
+		data    string
+		wantErr error
+	}{
+		{"same key", before, sealedBefore, "title", nil},
+		{"old key after rotation", rotated, sealedBefore, "title", nil},
+		{"new key after rotation", rotated, sealedAfter, "title", nil},
+		{"without a current key", openOnly, sealedAfter, "title", nil},
+		{"new key before rotation", before, sealedAfter, "title", ErrUnknownKey},
+		{"unrelated key", other, sealedBefore, "title", ErrUnknownKey},
+		{"wrong additional data", rotated, sealedAfter, "content", ErrCorrupt},
+		{"changed", rotated, changed, "title", ErrCorrupt},
+		{"cut short", rotated, sealedAfter[:Overhead-1], "title", ErrCorrupt},
+		{"plaintext", rotated, []byte("tom & jerry, but not sealed at all"), "title", ErrCorrupt},
+	}
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.keys.Open(tc.sealed, []byte(tc.data))
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Open returned error %v, wanted %v", err, tc.wantErr)
+			}
+			if err == nil && string(got) != "tom & jerry" {
+				t.Errorf("Open returned %q", got)
+			}
+		})
+	}
+
+	if !bytes.Equal(sealedAfter[1:1+idSize], rotated.CurrentID()) {
+		t.Errorf("sealed value doesn't start with the current key's ID")
+	}
+	if openOnly.Sealing() || openOnly.CurrentID() != nil || openOnly.Digest([]byte("a")) != nil {
+		t.Errorf("keyring without a current key claims to seal")
+	}
+	if bytes.Equal(before.Seal([]byte("a"), nil), before.Seal([]byte("a"), nil)) {
+		t.Errorf("sealing twice gave the same value")
+	}
+	if d := rotated.Digest([]byte("ab"), []byte("c")); !bytes.Equal(d, rotated.Digest([]byte("ab"), []byte("c"))) ||
+		bytes.Equal(d, rotated.Digest([]byte("a"), []byte("bc"))) ||
+		bytes.Equal(d, other.Digest([]byte("ab"), []byte("c"))) {
+		t.Errorf("digests don't depend on exactly the parts and the key")
+	}
+	if _, err := New([]byte("short")); err == nil {
+		t.Errorf("New accepted a 5 byte key")
+	}
+}
+
+func mustNew(t *testing.T, current []byte, old ...[]byte) *Keyring {
+	t.Helper()
+	k, err := New(current, old...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return k
+}
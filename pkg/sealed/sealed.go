@@ -0,0 +1,199 @@
+// Package sealed encrypts streams with AES-GCM in chunks, so that files too
+// big to hold in memory can be encrypted and authenticated.
+//
+// A stream starts with a header of Magic and a random nonce prefix. Each chunk
+// of up to ChunkSize bytes is sealed on its own with a nonce of the prefix and
+// the chunk's number. The last chunk is marked as such, so a stream cut short
+// on a chunk boundary fails to open rather than looking complete.
+package sealed
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic starts every sealed stream.
+const Magic = "PALSEAL1"
+
+// ChunkSize is the most plaintext sealed in one chunk.
+const ChunkSize = 64 << 10
+
+const prefixSize = 8
+
+var (
+	// ErrNotSealed is returned by NewReader if the stream doesn't start with
+	// Magic.
+	ErrNotSealed = errors.New("not a sealed stream")
+	// ErrCorrupt is returned if a chunk fails to open, because the key is
+	// wrong or the stream was changed or cut short.
+	ErrCorrupt = errors.New("sealed stream is corrupt or the key is wrong")
+)
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(prefix []byte, n uint32) []byte {
+	return binary.BigEndian.AppendUint32(bytes.Clone(prefix), n)
+}
+
+// additionalData marks the last chunk.
+func additionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Writer seals everything written to it. It must be closed to write the last
+// chunk.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	buf    []byte
+	closed bool
+}
+
+// NewWriter writes the header to w and returns a Writer sealing with key,
+// which must be 16, 24 or 32 bytes.
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, Magic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (s *Writer) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed sealed.Writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more is written, since the last
+		// chunk has to be marked.
+		if len(s.buf) == ChunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):ChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *Writer) seal(last bool) error {
+	sealed := s.aead.Seal(nil, nonce(s.prefix, s.n), s.buf, additionalData(last))
+	s.n++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (s *Writer) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+// Reader opens a sealed stream.
+type Reader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	chunk  []byte
+	buf    []byte
+	done   bool
+}
+
+// NewReader reads the header from r and returns a Reader opening the stream
+// with key.
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(Magic)+prefixSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(Magic)]) != Magic {
+		return nil, ErrNotSealed
+	}
+	return &Reader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		prefix: header[len(Magic):],
+		chunk:  make([]byte, ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *Reader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk. A chunk is the last one if it is short
+// or nothing follows it.
+func (s *Reader) open() error {
+	n, err := io.ReadFull(s.r, s.chunk)
+	switch {
+	case err == io.EOF:
+		// The previous chunk was full but not marked as the last.
+		return ErrCorrupt
+	case err == io.ErrUnexpectedEOF:
+		s.done = true
+	case err != nil:
+		return err
+	default:
+		if _, err := s.r.Peek(1); err == io.EOF {
+			s.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := s.aead.Open(nil, nonce(s.prefix, s.n), s.chunk[:n], additionalData(s.done))
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", s.n, ErrCorrupt)
+	}
+	s.n++
+	s.buf = plain
+	return nil
+}
@@ -0,0 +1,80 @@
+package sealed
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	table := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 100},
+		{"one chunk", ChunkSize},
+		{"chunk and a bit", ChunkSize + 1},
+		{"many chunks", 3*ChunkSize + 17},
+	}
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			plain := make([]byte, tc.size)
+			for i := range plain {
+				plain[i] = byte(i * 31)
+			}
+			var sealed bytes.Buffer
+			w, err := NewWriter(&sealed, key)
+			if err != nil {
+				t.Fatalf("NewWriter: %v", err)
+			}
+			if _, err := w.Write(plain); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			whole := sealed.Bytes()
+
+			got, err := open(whole, key)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("opened %d bytes, wanted the %d sealed", len(got), len(plain))
+			}
+
+			if _, err := open(whole, bytes.Repeat([]byte{8}, 32)); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("open with the wrong key returned %v", err)
+			}
+			// Cut off the last chunk, or part of it.
+			overhead := 16
+			for _, cut := range []int{1, overhead + tc.size%ChunkSize} {
+				if _, err := open(whole[:len(whole)-cut], key); !errors.Is(err, ErrCorrupt) {
+					t.Errorf("open of a stream missing %d bytes returned %v", cut, err)
+				}
+			}
+			flipped := bytes.Clone(whole)
+			flipped[len(flipped)/2+len(Magic)] ^= 1
+			if _, err := open(flipped, key); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("open of a changed stream returned %v", err)
+			}
+		})
+	}
+}
+
+func TestNotSealed(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("SQLite format 3")), make([]byte, 16)); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("NewReader of plain data returned %v", err)
+	}
+}
+
+func open(sealed, key []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,182 @@
+// Package shingle finds passages in text by the runs of words they share,
+// ignoring case, punctuation and whitespace. A few changed words only lose the
+// shingles that overlap them, so near quotes still match.
+package shingle
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Size is the number of words in a shingle.
+const Size = 3
+
+// Word is a normalized word and where it was found in the original text.
+type Word struct {
+	Text string
+	// Start and End are byte offsets into the original text.
+	Start, End int
+}
+
+// Words splits text into lower case words of letters and digits. Apostrophes
+// are dropped rather than splitting words, so "don't" and "dont" are alike.
+func Words(text string) []Word {
+	var words []Word
+	var b strings.Builder
+	start := -1
+	flush := func(end int) {
+		if start >= 0 && b.Len() > 0 {
+			words = append(words, Word{Text: b.String(), Start: start, End: end})
+		}
+		b.Reset()
+		start = -1
+	}
+	for i, r := range text {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if start < 0 {
+				start = i
+			}
+			b.WriteRune(unicode.ToLower(r))
+		case r == '\'' || r == '’':
+			// Part of the word, but not worth keeping.
+		default:
+			flush(i)
+		}
+	}
+	flush(len(text))
+	return words
+}
+
+// Pattern is a compiled passage to look for.
+type Pattern struct {
+	n        int
+	shingles map[string]bool
+	count    int
+	// Words are the normalized words of the passage.
+	Words []Word
+}
+
+// Compile prepares passage for matching. Passages shorter than a shingle are
+// matched as a single shingle of all their words.
+func Compile(passage string) Pattern {
+	words := Words(passage)
+	p := Pattern{
+		n:        min(Size, len(words)),
+		shingles: make(map[string]bool),
+		Words:    words,
+	}
+	if p.n == 0 {
+		return p
+	}
+	for i := 0; i+p.n <= len(words); i++ {
+		p.shingles[key(words[i:i+p.n])] = true
+		p.count++
+	}
+	return p
+}
+
+func key(words []Word) string {
+	texts := make([]string, len(words))
+	for i, w := range words {
+		texts[i] = w.Text
+	}
+	return strings.Join(texts, " ")
+}
+
+// Match is the part of a text that best matches a pattern.
+type Match struct {
+	// Start and End are byte offsets into the text.
+	Start, End int
+	// Score is the fraction of the pattern's shingles found in the span.
+	Score float64
+}
+
+// Find returns the span of text sharing the most shingles with the pattern. The
+// span may be a little longer than the passage to allow for inserted words. It
+// returns false if nothing is shared at all.
+func (p Pattern) Find(text string) (Match, bool) {
+	if p.count == 0 {
+		return Match{}, false
+	}
+	words := Words(text)
+	if len(words) < p.n {
+		return Match{}, false
+	}
+
+	hits := make([]string, len(words)-p.n+1)
+	for i := range hits {
+		if k := key(words[i : i+p.n]); p.shingles[k] {
+			hits[i] = k
+		}
+	}
+
+	// Slide a window a bit wider than the passage over the text and keep the
+	// one with the most distinct shingles, so that repeated phrases in the text
+	// don't count twice.
+	width := p.count + max(2, p.count/5)
+	inWindow := make(map[string]int)
+	best, bestAt := 0, 0
+	for i := range hits {
+		if hits[i] != "" {
+			inWindow[hits[i]]++
+		}
+		if i >= width && hits[i-width] != "" {
+			if inWindow[hits[i-width]]--; inWindow[hits[i-width]] == 0 {
+				delete(inWindow, hits[i-width])
+			}
+		}
+		if len(inWindow) > best {
+			best, bestAt = len(inWindow), max(0, i-width+1)
+		}
+	}
+	if best == 0 {
+		return Match{}, false
+	}
+
+	// Trim the window down to the hits, dropping repeats at either end.
+	first, last := bestAt, min(bestAt+width, len(hits))-1
+	counts := make(map[string]int)
+	for _, k := range hits[first : last+1] {
+		counts[k]++
+	}
+	for hits[first] == "" || counts[hits[first]] > 1 {
+		counts[hits[first]]--
+		first++
+	}
+	for hits[last] == "" || counts[hits[last]] > 1 {
+		counts[hits[last]]--
+		last--
+	}
+	return Match{
+		Start: words[first].Start,
+		End:   words[last+p.n-1].End,
+		Score: min(1, float64(best)/float64(p.count)),
+	}, true
+}
+
+// Context returns the match with up to n bytes of text either side, cut at
+// whitespace. It returns the text before, in and after the match.
+func Context(text string, m Match, n int) (before, match, after string) {
+	start := m.Start - n
+	if start <= 0 {
+		start = 0
+	} else if i := strings.IndexFunc(text[start:m.Start], unicode.IsSpace); i >= 0 {
+		start += i + 1
+	} else {
+		start = m.Start
+	}
+	end := m.End + n
+	if end >= len(text) {
+		end = len(text)
+	} else if i := strings.LastIndexFunc(text[m.End:end], unicode.IsSpace); i >= 0 {
+		end = m.End + i
+	} else {
+		end = m.End
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start++
+	}
+	return text[start:m.Start], text[m.Start:m.End], text[m.End:end]
+}
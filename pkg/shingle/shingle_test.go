@@ -0,0 +1,61 @@
+package shingle
+
+import "testing"
+
+func TestFind(t *testing.T) {
+	const text = "It was the best of times, it was the worst of times, it was the age of wisdom, it was the age of foolishness."
+	table := []struct {
+		name, passage string
+		want          string
+		wantScore     float64
+		wantOK        bool
+	}{{
+		name:      "exact",
+		passage:   "it was the age of wisdom",
+		want:      "it was the age of wisdom",
+		wantScore: 1,
+		wantOK:    true,
+	}, {
+		name:      "punctuation and case",
+		passage:   "WORST of times -- it was   the age",
+		want:      "worst of times, it was the age",
+		wantScore: 1,
+		wantOK:    true,
+	}, {
+		name:      "changed word",
+		passage:   "the worst of days, it was the age of wisdom",
+		want:      "the worst of times, it was the age of wisdom",
+		wantScore: 5.0 / 8,
+		wantOK:    true,
+	}, {
+		name:      "short",
+		passage:   "foolishness",
+		want:      "foolishness",
+		wantScore: 1,
+		wantOK:    true,
+	}, {
+		name:    "missing",
+		passage: "call me ishmael",
+		wantOK:  false,
+	}, {
+		name:    "empty",
+		passage: " ... ",
+		wantOK:  false,
+	}}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			m, ok := Compile(tc.passage).Find(text)
+			if ok != tc.wantOK {
+				t.Fatalf("Find(%q) returned ok=%t, wanted %t", tc.passage, ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := text[m.Start:m.End]; got != tc.want || m.Score != tc.wantScore {
+				t.Errorf("Find(%q) returned %q with score %v, wanted %q with score %v",
+					tc.passage, got, m.Score, tc.want, tc.wantScore)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+-- https://kerkour.com/sqlite-for-servers
+PRAGMA journal_mode = WAL;
+PRAGMA busy_timeout = 30000; -- 30s.
+PRAGMA synchronous = NORMAL;
+PRAGMA cache_size = 1000000000; -- 1e9 pages.
+PRAGMA foreign_keys = true;
+PRAGMA temp_store = memory;
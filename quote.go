@@ -0,0 +1,190 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/prettytime"
+	"github.com/spencer-p/palace/pkg/shingle"
+)
+
+const (
+	// quoteCandidates is how many full text matches are checked for a quote.
+	quoteCandidates = 200
+	// quoteTerms caps the number of words used to find candidates.
+	quoteTerms = 64
+	// minQuoteScore is the fraction of a passage's shingles that a page must
+	// contain to be shown.
+	minQuoteScore = 0.5
+	// quoteContext is roughly how many bytes of the page are shown either side
+	// of a quote.
+	quoteContext = 200
+)
+
+// QuoteMatch is a page containing a quoted passage.
+type QuoteMatch struct {
+	SearchResult
+	// Score is the fraction of the passage found on the page.
+	Score float64
+	// SafeContext is the matching span of the page in <mark> tags, with some
+	// of the text around it.
+	SafeContext template.HTML
+}
+
+// Percent is the score as a whole percentage.
+func (m QuoteMatch) Percent() int {
+	return int(math.Round(m.Score * 100))
+}
+
+// FindQuote finds pages containing passage, or something close to it. The
+// full text index only narrows down the candidates. Those are then compared
+// word by word, so the order of words matters but punctuation, case and the odd
+// changed word don't.
+func (db *DB) FindQuote(passage string, limit int) ([]QuoteMatch, error) {
+	pattern := shingle.Compile(passage)
+	var terms []string
+	seen := make(map[string]bool)
+	for _, w := range pattern.Words {
+		if !seen[w.Text] && len(terms) < quoteTerms {
+			seen[w.Text] = true
+			terms = append(terms, quoteFTS(w.Text))
+		}
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.read.Query(`
+	SELECT id, url, scraped_at, web_data.title, web_data.content
+	FROM web_data
+	INNER JOIN search_index ON web_data.id = search_index.rowid
+	WHERE search_index MATCH ? AND `+notTrashed+`
+	ORDER BY rank
+	LIMIT ?`,
+		strings.Join(terms, " OR "), quoteCandidates,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var matches []QuoteMatch
+	for rows.Next() {
+		var m QuoteMatch
+		var scrapeTime string
+		if err := rows.Scan(&m.ID, &m.URL, &scrapeTime, db.opened("title", &m.SafeTitle), db.opened("content", &m.SafeContent)); err != nil {
+			return nil, fmt.Errorf("candidate %d: scan: %w", len(matches), err)
+		}
+		content := html.UnescapeString(string(m.SafeContent))
+		found, ok := pattern.Find(content)
+		if !ok || found.Score < minQuoteScore {
+			continue
+		}
+		t, err := timeFromDB(scrapeTime)
+		if err != nil {
+			return nil, fmt.Errorf("candidate %d: %w", len(matches), err)
+		}
+		m.ScrapedAt = t
+		m.ScrapedAgo = prettytime.DurationBetween(now, t)
+		m.Score = found.Score
+		m.SafeContext = quoteContextHTML(content, found)
+		m.SafeContent = ""
+		matches = append(matches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Best matches first, and only the newest copy of each URL among equals.
+	slices.SortStableFunc(matches, func(a, b QuoteMatch) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(b.ID, a.ID))
+	})
+	urls := make(map[string]bool)
+	matches = slices.DeleteFunc(matches, func(m QuoteMatch) bool {
+		dup := urls[m.URL]
+		urls[m.URL] = true
+		return dup
+	})
+	return matches[:min(limit, len(matches))], nil
+}
+
+// quoteContextHTML escapes the match and its surroundings, marking the match.
+func quoteContextHTML(content string, m shingle.Match) template.HTML {
+	before, match, after := shingle.Context(content, m, quoteContext)
+	var b strings.Builder
+	if len(before) < m.Start {
+		b.WriteString("...")
+	}
+	b.WriteString(html.EscapeString(before))
+	b.WriteString("<mark>")
+	b.WriteString(html.EscapeString(match))
+	b.WriteString("</mark>")
+	b.WriteString(html.EscapeString(after))
+	if m.End+len(after) < len(content) {
+		b.WriteString("...")
+	}
+	return template.HTML(b.String())
+}
+
+func makeQuote(store QuoteFinder) func(w http.ResponseWriter, r *http.Request) {
+	quoteTemplate := template.Must(template.ParseFS(staticContent, "static/quote.template.html"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		passage := r.FormValue("q")
+		start := time.Now()
+		matches, err := store.FindQuote(passage, defaultPageSize)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("quote: failed to query for %q: %v", passage, err)
+			return
+		}
+		took := time.Since(start)
+
+		w.WriteHeader(http.StatusOK)
+		if err := quoteTemplate.Execute(w, map[string]any{
+			"Root":    prefix,
+			"Query":   passage,
+			"Took":    took.Round(time.Millisecond),
+			"Results": matches,
+		}); err != nil {
+			log.Errorf("failed to render quote search: %v", err)
+		}
+	}
+}
+
+type apiQuoteMatch struct {
+	apiResult
+	Score float64 `json:"score"`
+	// Context is HTML with the matching span in <mark> tags.
+	Context string `json:"context"`
+}
+
+func makeQuoteAPI(store QuoteFinder) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		passage := r.FormValue("q")
+		matches, err := store.FindQuote(passage, defaultPageSize)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("quote API: failed to query for %q: %v", passage, err)
+			return
+		}
+
+		resp := make([]apiQuoteMatch, len(matches))
+		for i, m := range matches {
+			resp[i] = apiQuoteMatch{
+				apiResult: toAPIResult(m.SearchResult),
+				Score:     m.Score,
+				Context:   string(m.SafeContext),
+			}
+		}
+		writeJSON(w, resp)
+	}
+}
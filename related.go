@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spencer-p/palace/pkg/embed"
+	"github.com/spencer-p/palace/pkg/prettytime"
+)
+
+// relatedDepth is how many neighbours are considered before dropping other
+// versions of the same URL.
+const relatedDepth = 50
+
+// Related finds up to n pages similar to the page with the given id, using the
+// average of its chunk vectors as a fingerprint. Other versions of the same URL
+// are left out, and each URL appears once.
+func (db *DB) Related(id int64, n int) ([]SearchResult, error) {
+	if db.Embedder == nil {
+		return nil, nil
+	}
+	fingerprint, err := db.fingerprint(id)
+	if err != nil || fingerprint == nil {
+		return nil, err
+	}
+	nearest, err := db.nearest(fingerprint, relatedDepth)
+	if err != nil {
+		return nil, err
+	}
+	if len(nearest) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, len(nearest))
+	for i, p := range nearest {
+		ids[i] = p.ID
+	}
+	in, args := inList(ids)
+	rows, err := db.read.Query(`
+	SELECT id, url, scraped_at, title
+	FROM web_data
+	WHERE id IN `+in+` AND `+notTrashed+` AND url != (SELECT url FROM web_data WHERE id = ?)`,
+		append(args, id)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	byID := make(map[int64]SearchResult)
+	for rows.Next() {
+		var r SearchResult
+		var scrapeTime string
+		if err := rows.Scan(&r.ID, &r.URL, &scrapeTime, db.opened("title", &r.SafeTitle)); err != nil {
+			return nil, fmt.Errorf("column %d: scan: %w", len(byID), err)
+		}
+		t, err := timeFromDB(scrapeTime)
+		if err != nil {
+			return nil, fmt.Errorf("column %d: %w", len(byID), err)
+		}
+		r.ScrapedAt = t
+		r.ScrapedAgo = prettytime.DurationBetween(now, t)
+		byID[int64(r.ID)] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var related []SearchResult
+	seen := make(map[string]bool)
+	for _, p := range nearest {
+		r, ok := byID[p.ID]
+		if !ok || seen[r.URL] {
+			continue
+		}
+		seen[r.URL] = true
+		related = append(related, r)
+		if len(related) == n {
+			break
+		}
+	}
+	return related, nil
+}
+
+// fingerprint averages the chunk vectors of a page. It is nil if the page has
+// not been embedded.
+func (db *DB) fingerprint(id int64) ([]float32, error) {
+	rows, err := db.read.Query(`SELECT vector FROM chunk_vectors WHERE page_id = ? AND model = ?`, id, db.Embedder.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sum []float32
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		vec := embed.Decode(blob)
+		if sum == nil {
+			sum = make([]float32, len(vec))
+		}
+		for i := range min(len(sum), len(vec)) {
+			sum[i] += vec[i]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return embed.Normalize(sum), nil
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// replicaDir is where the write-ahead log is shipped for point in time
+// recovery, or "" to not replicate.
+var replicaDir = os.Getenv("REPLICA_DIR")
+
+var (
+	// replicaSyncInterval is how often new transactions are shipped, and so
+	// about how much is lost if the disk dies.
+	replicaSyncInterval = envDuration("REPLICA_SYNC_INTERVAL", time.Second)
+	// replicaSnapshotInterval is how often a new generation is started, which
+	// bounds how much log a restore replays.
+	replicaSnapshotInterval = envDuration("REPLICA_SNAPSHOT_INTERVAL", 24*time.Hour)
+	// replicaRetention is how long old generations are kept.
+	replicaRetention = envDuration("REPLICA_RETENTION", 7*24*time.Hour)
+)
+
+const (
+	// replicaTimeFormat names generations and segments. It has milliseconds
+	// so that a busy database's generations sort in order.
+	replicaTimeFormat  = "20060102T150405.000Z"
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	// replicaCheckpointSize is how big the log grows before it is copied into
+	// the database and started over.
+	replicaCheckpointSize = 4 << 20
+)
+
+// replicaPragmas turn off automatic checkpoints, so that the log is never
+// checkpointed before it has been shipped.
+var replicaPragmas = []string{"wal_autocheckpoint(0)"}
+
+// Replicator ships the database's write-ahead log to a directory.
+//
+// The replica is made of generations, each a snapshot of the database and the
+// log written after it:
+//
+//	<dir>/<generation>/snapshot.db.gz
+//	<dir>/<generation>/wal/<index>-<offset>-<time>.wal.gz
+//
+// Generations are named for the time of their snapshot. The index counts how
+// many times the log has been checkpointed and started over within the
+// generation, and the offset is where the segment starts in that log. Segments
+// are copied while holding the write lock, so each ends on a committed
+// transaction.
+//
+// Palace turns off automatic checkpoints and leaves them to the replicator.
+// If the log starts over without the replicator seeing all of it, a new
+// generation begins.
+type Replicator struct {
+	db     *DB
+	dbFile string
+	dir    string
+	config BackupConfig
+
+	// mu serializes syncs, checkpoints and snapshots.
+	mu sync.Mutex
+
+	generation string
+	started    time.Time
+	index      int
+	offset     int64
+	salt       []byte
+}
+
+// NewReplicator starts a new generation of the database's replica in dir.
+// Segments are compressed, and encrypted if config has a key.
+func NewReplicator(db *DB, dir string, config BackupConfig) (*Replicator, error) {
+	dbFile, err := db.filename()
+	if err != nil {
+		return nil, err
+	}
+	r := &Replicator{db: db, dbFile: dbFile, dir: dir, config: config}
+	if err := r.newGeneration(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Replicator) ext() string {
+	if r.config.Key != nil {
+		return ".gz.enc"
+	}
+	return ".gz"
+}
+
+// hold takes the database's only writer connection, so that nothing else in
+// this process writes until it is closed.
+func (r *Replicator) hold() (*sql.Conn, error) {
+	conn, err := r.db.Conn(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to hold the writer: %w", err)
+	}
+	return conn, nil
+}
+
+// lockWrites takes the write lock on the held writer connection, so the log
+// can be read while no transaction is half written, by this process or another.
+func lockWrites(conn *sql.Conn) (unlock func(), err error) {
+	ctx := context.Background()
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return nil, fmt.Errorf("failed to lock writes: %w", err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, `ROLLBACK`); err != nil {
+			log.Warnf("Replicator failed to unlock writes: %v", err)
+		}
+	}, nil
+}
+
+// truncateLog copies the log into the database and truncates it, or returns an
+// error if readers kept it from finishing.
+func (r *Replicator) truncateLog() error {
+	var busy, logFrames, checkpointed int64
+	err := r.db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("checkpoint blocked, %d of %d frames copied", checkpointed, logFrames)
+	}
+	return nil
+}
+
+// frameStride is the size of a log frame in the database.
+func (r *Replicator) frameStride() int64 {
+	var pageSize int64
+	r.db.read.QueryRow(`PRAGMA page_size`).Scan(&pageSize)
+	return walFrameHeaderSize + pageSize
+}
+
+// newGeneration snapshots the database with an empty log, and ships log from
+// there on.
+func (r *Replicator) newGeneration() error {
+	for tries := 0; ; tries++ {
+		if err := r.truncateLog(); err != nil {
+			if tries >= 10 {
+				return err
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		done, err := r.snapshot()
+		if err != nil || done {
+			return err
+		}
+		// A write landed between the checkpoint and the snapshot. Go again.
+	}
+}
+
+// snapshot copies the database file into a new generation if the log is
+// empty, and reports whether it did.
+func (r *Replicator) snapshot() (bool, error) {
+	conn, err := r.hold()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	unlock, err := lockWrites(conn)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if info, err := os.Stat(r.dbFile + "-wal"); err == nil && info.Size() > 0 {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	generation := now.Format(replicaTimeFormat)
+	genDir := filepath.Join(r.dir, generation)
+	if err := os.MkdirAll(filepath.Join(genDir, "wal"), 0o700); err != nil {
+		return false, err
+	}
+	partial := filepath.Join(genDir, "snapshot.partial")
+	defer os.Remove(partial)
+	// The write lock keeps the database file as it is while it is copied.
+	if err := r.config.pack(r.dbFile, partial); err != nil {
+		return false, fmt.Errorf("failed to snapshot: %w", err)
+	}
+	if err := os.Rename(partial, filepath.Join(genDir, "snapshot.db"+r.ext())); err != nil {
+		return false, err
+	}
+
+	r.generation, r.started = generation, now
+	r.index, r.offset, r.salt = 0, 0, nil
+	log.Infof("Started replica generation %s", generation)
+	return true, nil
+}
+
+// sync ships the transactions committed since the last sync.
+func (r *Replicator) sync() error {
+	conn, err := r.hold()
+	if err != nil {
+		return err
+	}
+	return r.syncHeld(conn)
+}
+
+// syncHeld is sync with the writer connection already held. It lets go of it.
+func (r *Replicator) syncHeld(conn *sql.Conn) error {
+	unlock, err := lockWrites(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	restarted, err := r.shipLog()
+	unlock()
+	conn.Close()
+	if restarted {
+		// Someone else checkpointed the log, so some of it was never
+		// shipped.
+		log.Warnf("Replica missed part of the log, starting a new generation")
+		return r.newGeneration()
+	}
+	return err
+}
+
+// shipLog copies the transactions in the log from the last offset on. It
+// reports whether the log started over without the replicator.
+func (r *Replicator) shipLog() (bool, error) {
+	f, err := os.Open(r.dbFile + "-wal")
+	if errors.Is(err, os.ErrNotExist) {
+		return r.offset > 0, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(f, header); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return r.offset > 0, nil
+	} else if err != nil {
+		return false, err
+	}
+	salt := header[16:24]
+	if r.offset > 0 && !bytes.Equal(salt, r.salt) {
+		return true, nil
+	}
+	if r.offset == 0 && bytes.Equal(salt, r.salt) {
+		// The log we checkpointed is still there until the next write starts
+		// it over.
+		return false, nil
+	}
+	end, err := walCommitted(f, header, r.offset)
+	if err != nil || end == r.offset {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%08d-%012d-%s.wal%s", r.index, r.offset, now.Format(replicaTimeFormat), r.ext())
+	path := filepath.Join(r.dir, r.generation, "wal", name)
+	if err := r.writeSegment(path, io.NewSectionReader(f, r.offset, end-r.offset)); err != nil {
+		return false, fmt.Errorf("failed to ship log: %w", err)
+	}
+	r.offset, r.salt = end, bytes.Clone(salt)
+	return false, nil
+}
+
+// walCommitted finds the end of the last committed transaction in the log
+// with the given header, reading frames from offset on. The file can be longer
+// than the log in it, because SQLite starts a log over by overwriting it.
+func walCommitted(f *os.File, header []byte, offset int64) (int64, error) {
+	stride := walFrameHeaderSize + int64(binary.BigEndian.Uint32(header[8:12]))
+	end := max(offset, walHeaderSize)
+	frame := make([]byte, walFrameHeaderSize)
+	for pos := end; ; pos += stride {
+		if _, err := f.ReadAt(frame, pos); errors.Is(err, io.EOF) {
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(frame[8:16], header[16:24]) {
+			return end, nil
+		}
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			end = pos + stride
+		}
+	}
+}
+
+func (r *Replicator) writeSegment(path string, segment io.Reader) error {
+	partial := path + ".partial"
+	defer os.Remove(partial)
+	out, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w, err := r.config.packWriter(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, segment); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// Checkpoint ships the log, then copies it into the database and starts it
+// over. It describes what it did, like maintenanceOps.
+func (r *Replicator) Checkpoint() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checkpoint()
+}
+
+func (r *Replicator) checkpoint() (string, error) {
+	if err := r.sync(); err != nil {
+		return "", err
+	}
+	if r.offset == 0 {
+		return "the log is empty", nil
+	}
+	// A restart checkpoint leaves the log in place but makes the next write
+	// start it over, which shipLog notices by its new salt.
+	conn, err := r.hold()
+	if err != nil {
+		return "", err
+	}
+	var busy, logFrames, checkpointed int64
+	err = conn.QueryRowContext(context.Background(), `PRAGMA wal_checkpoint(RESTART)`).Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	if busy != 0 {
+		conn.Close()
+		return "", fmt.Errorf("checkpoint blocked, %d of %d frames copied", checkpointed, logFrames)
+	}
+
+	// Ship what was committed between the sync and the checkpoint. Holding
+	// the writer throughout keeps writes here from starting the log over
+	// first, though another process still might.
+	generation := r.generation
+	if err := r.syncHeld(conn); err != nil {
+		return "", err
+	}
+	if r.generation != generation {
+		return "checkpointed and started a new generation", nil
+	}
+	if shippedFrames := (r.offset - walHeaderSize) / r.frameStride(); logFrames != shippedFrames {
+		log.Warnf("Replica shipped %d of %d frames at checkpoint, starting a new generation", shippedFrames, logFrames)
+		if err := r.newGeneration(); err != nil {
+			return "", err
+		}
+		return "checkpointed and started a new generation", nil
+	}
+	r.index, r.offset = r.index+1, 0
+	return fmt.Sprintf("%d frames copied", logFrames), nil
+}
+
+// Run ships the log every interval. It is meant to be run in the background.
+func (r *Replicator) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := r.tick(); err != nil {
+			log.Errorf("Failed to replicate: %v", err)
+		}
+	}
+}
+
+// tick ships the log, then starts a new generation if the current one is old,
+// or checkpoints the log if it has grown big.
+func (r *Replicator) tick() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.sync(); err != nil {
+		return err
+	}
+	if time.Since(r.started) > replicaSnapshotInterval {
+		if err := r.newGeneration(); err != nil {
+			return fmt.Errorf("failed to start a new generation: %w", err)
+		}
+		if err := pruneGenerations(r.dir, r.generation, replicaRetention); err != nil {
+			log.Warnf("Failed to delete old replica generations: %v", err)
+		}
+		return nil
+	}
+	if r.offset > replicaCheckpointSize {
+		if _, err := r.checkpoint(); err != nil {
+			log.Warnf("Replica checkpoint failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// generations lists the generations in dir, oldest first, with the times of
+// their snapshots.
+func generations(dir string) ([]string, []time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	var times []time.Time
+	for _, e := range entries {
+		t, err := time.Parse(replicaTimeFormat, e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		names = append(names, e.Name())
+		times = append(times, t)
+	}
+	return names, times, nil
+}
+
+// pruneGenerations deletes the generations older than retention, except for
+// current. A generation is needed until the next one starts, so its age is
+// when it was replaced.
+func pruneGenerations(dir, current string, retention time.Duration) error {
+	names, times, err := generations(dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(names); i++ {
+		if names[i] == current || time.Since(times[i+1]) <= retention {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, names[i])); err != nil {
+			return err
+		}
+		log.Infof("Deleted replica generation %s", names[i])
+	}
+	return nil
+}
+
+// walSegment is a piece of shipped log.
+type walSegment struct {
+	Name   string
+	Index  int
+	Offset int64
+	Time   time.Time
+}
+
+func parseSegmentName(name string) (walSegment, bool) {
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) != 3 {
+		return walSegment{}, false
+	}
+	index, err1 := strconv.Atoi(parts[0])
+	offset, err2 := strconv.ParseInt(parts[1], 10, 64)
+	stamp, _, _ := strings.Cut(parts[2], ".wal")
+	t, err3 := time.Parse(replicaTimeFormat, stamp)
+	if err1 != nil || err2 != nil || err3 != nil || strings.HasSuffix(name, ".partial") {
+		return walSegment{}, false
+	}
+	return walSegment{Name: name, Index: index, Offset: offset, Time: t}, true
+}
+
+// RestoreReplica rebuilds the database at dbFile as it was at the given time,
+// or as late as possible if the time is zero, from the replica in dir. Like
+// BackupConfig.Restore, the result is checked before it replaces dbFile, and
+// Palace must not be running.
+func RestoreReplica(dir string, at time.Time, config BackupConfig, dbFile string) (time.Time, error) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	names, times, err := generations(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	gen := -1
+	for i := range names {
+		if !times[i].After(at) {
+			gen = i
+		}
+	}
+	if gen < 0 {
+		return time.Time{}, fmt.Errorf("no replica generation started before %v", at)
+	}
+	genDir := filepath.Join(dir, names[gen])
+	log.Infof("Restoring from generation %s", names[gen])
+
+	snapshot := filepath.Join(genDir, "snapshot.db.gz")
+	if _, err := os.Stat(snapshot + ".enc"); err == nil {
+		snapshot += ".enc"
+	}
+	restored := dbFile + ".restoring"
+	os.Remove(restored)
+	defer os.Remove(restored)
+	if err := config.unpack(snapshot, restored); err != nil {
+		return time.Time{}, fmt.Errorf("failed to unpack snapshot: %w", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(genDir, "wal"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var segments []walSegment
+	for _, e := range entries {
+		if s, ok := parseSegmentName(e.Name()); ok && !s.Time.After(at) {
+			segments = append(segments, s)
+		}
+	}
+	slices.SortFunc(segments, func(a, b walSegment) int {
+		if a.Index != b.Index {
+			return a.Index - b.Index
+		}
+		return int(a.Offset - b.Offset)
+	})
+
+	restoredTo := times[gen]
+	for start := 0; start < len(segments); {
+		end := start
+		for end < len(segments) && segments[end].Index == segments[start].Index {
+			end++
+		}
+		if err := replayLog(genDir, segments[start:end], config, restored); err != nil {
+			return time.Time{}, fmt.Errorf("log %d: %w", segments[start].Index, err)
+		}
+		restoredTo = segments[end-1].Time
+		start = end
+	}
+
+	if err := checkRestored(restored); err != nil {
+		return time.Time{}, fmt.Errorf("restored database is broken: %w", err)
+	}
+	return restoredTo, swapIn(restored, dbFile)
+}
+
+// replayLog rebuilds one log from its segments next to the database and lets
+// SQLite apply it.
+func replayLog(genDir string, segments []walSegment, config BackupConfig, dbFile string) error {
+	wal, err := os.OpenFile(dbFile+"-wal", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer wal.Close()
+
+	var written int64
+	for _, s := range segments {
+		if s.Offset != written {
+			return fmt.Errorf("segment %s does not follow the %d bytes before it", s.Name, written)
+		}
+		in, err := os.Open(filepath.Join(genDir, "wal", s.Name))
+		if err != nil {
+			return err
+		}
+		r, err := config.unpackReader(in, strings.HasSuffix(s.Name, ".enc"))
+		if err == nil {
+			var n int64
+			n, err = io.Copy(wal, r)
+			written += n
+		}
+		in.Close()
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", s.Name, err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		return err
+	}
+
+	// Opening the database recovers the log, a checkpoint writes it in, and
+	// closing the database removes it.
+	db, err := OpenDB(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var busy, logFrames, checkpointed, pageSize int64
+	if err := db.QueryRow(`PRAGMA wal_checkpoint(FULL)`).Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 || checkpointed != logFrames {
+		return fmt.Errorf("only %d of %d frames applied", checkpointed, logFrames)
+	}
+	if err := db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return err
+	}
+	if want := (written - walHeaderSize) / (walFrameHeaderSize + pageSize); logFrames != want {
+		return fmt.Errorf("only %d of %d frames were valid", logFrames, want)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newReplicatedDB opens a database at path that replicates to dir, as the
+// server does with REPLICA_DIR set.
+func newReplicatedDB(t *testing.T, path, dir string, config BackupConfig) (*DB, *Replicator) {
+	t.Helper()
+	db, err := NewDB(path, replicaPragmas...)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if db.replica, err = NewReplicator(db, dir, config); err != nil {
+		t.Fatalf("NewReplicator: %v", err)
+	}
+	return db, db.replica
+}
+
+// restoredURLs restores the replica in dir as of at and lists the URLs saved
+// in the result.
+func restoredURLs(t *testing.T, dir string, at time.Time, config BackupConfig) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "restored.db")
+	if _, err := RestoreReplica(dir, at, config, path); err != nil {
+		t.Fatalf("RestoreReplica(%v): %v", at, err)
+	}
+	return savedURLs(t, path)
+}
+
+func mustTick(t *testing.T, r *Replicator) {
+	t.Helper()
+	if err := r.tick(); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+	// Segments are named to the millisecond, keep them apart.
+	time.Sleep(5 * time.Millisecond)
+}
+
+func TestReplica(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config BackupConfig
+	}{
+		{"plain", BackupConfig{}},
+		{"encrypted", BackupConfig{Key: testKey(7)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, r := newReplicatedDB(t, filepath.Join(t.TempDir(), "palace.db"), dir, tc.config)
+
+			mustSave(t, db, testPage("https://a.com/", "A", "first page"))
+			mustTick(t, r)
+			afterA := time.Now()
+			time.Sleep(5 * time.Millisecond)
+
+			if _, err := r.Checkpoint(); err != nil {
+				t.Fatalf("Checkpoint: %v", err)
+			}
+			mustSave(t, db, testPage("https://b.com/", "B", "second page"))
+			mustTick(t, r)
+			mustSave(t, db, testPage("https://c.com/", "C", "third page"))
+			mustTick(t, r)
+
+			segments, err := os.ReadDir(filepath.Join(dir, r.generation, "wal"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) != 3 {
+				t.Errorf("got %d segments, wanted 3", len(segments))
+			}
+			for _, s := range segments {
+				if encrypted := strings.HasSuffix(s.Name(), ".enc"); encrypted != (tc.config.Key != nil) {
+					t.Errorf("segment %s has the wrong extension", s.Name())
+				}
+			}
+
+			want := []string{"https://a.com/", "https://b.com/", "https://c.com/"}
+			if got := restoredURLs(t, dir, time.Time{}, tc.config); !slices.Equal(got, want) {
+				t.Errorf("restored latest to %q, wanted %q", got, want)
+			}
+			if got := restoredURLs(t, dir, afterA, tc.config); !slices.Equal(got, want[:1]) {
+				t.Errorf("restored to between segments to %q, wanted %q", got, want[:1])
+			}
+			if tc.config.Key != nil {
+				path := filepath.Join(t.TempDir(), "restored.db")
+				if _, err := RestoreReplica(dir, time.Time{}, BackupConfig{}, path); err == nil {
+					t.Errorf("restored an encrypted replica without its key")
+				}
+			}
+		})
+	}
+}
+
+// TestReplicaRestarted checks that a log started over by another process,
+// which the replicator can't have shipped all of, starts a new generation.
+func TestReplicaRestarted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "palace.db")
+	db, r := newReplicatedDB(t, path, dir, BackupConfig{})
+
+	mustSave(t, db, testPage("https://a.com/", "A", "first page"))
+	mustTick(t, r)
+	first := r.generation
+
+	other, err := OpenDB(path)
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer other.Close()
+	if _, err := other.Exec(`INSERT INTO web_data(url, scraped_at, title, content) VALUES ('https://b.com/', ?, 'B', 'unshipped')`,
+		time.Now().Format(ISO8601TZ)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Exec(`INSERT INTO web_data(url, scraped_at, title, content) VALUES ('https://c.com/', ?, 'C', 'new log')`,
+		time.Now().Format(ISO8601TZ)); err != nil {
+		t.Fatal(err)
+	}
+
+	mustTick(t, r)
+	if r.generation == first {
+		t.Fatalf("still on generation %s after the log started over", first)
+	}
+	names, _, err := generations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Errorf("got generations %q, wanted 2", names)
+	}
+
+	mustSave(t, db, testPage("https://d.com/", "D", "after the new generation"))
+	mustTick(t, r)
+	want := []string{"https://a.com/", "https://b.com/", "https://c.com/", "https://d.com/"}
+	if got := restoredURLs(t, dir, time.Time{}, BackupConfig{}); !slices.Equal(got, want) {
+		t.Errorf("restored %q, wanted %q", got, want)
+	}
+}
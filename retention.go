@@ -0,0 +1,402 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// retention is the policy the janitor enforces, set by the RETAIN_ variables.
+var retention = retentionFromEnv()
+
+// retentionInterval is how often the janitor runs.
+var retentionInterval = envDuration("RETAIN_INTERVAL", time.Hour)
+
+const (
+	// pruneBatch is how many pages are deleted per statement. Each statement
+	// holds the write lock, so small batches let scrapes through in between.
+	pruneBatch      = 100
+	pruneBatchPause = 50 * time.Millisecond
+)
+
+// RetentionPolicy decides which pages are deleted to keep the database from
+// growing forever. The zero policy keeps everything.
+type RetentionPolicy struct {
+	// MaxAge is how long pages are kept, or forever if zero.
+	MaxAge time.Duration
+	// MaxBytes caps the total size of titles and content. The oldest pages
+	// past the cap are deleted. Zero is no cap.
+	MaxBytes int64
+	// Sites override MaxAge for hosts and their subdomains. Zero keeps a
+	// site's pages forever, although they still count towards MaxBytes.
+	Sites map[string]time.Duration
+	// KeepPinned spares pinned pages from every rule.
+	KeepPinned bool
+}
+
+func (p RetentionPolicy) IsZero() bool {
+	return p.MaxAge == 0 && p.MaxBytes == 0 && len(p.Sites) == 0
+}
+
+// maxAge is how long pages from rawURL are kept, and the site whose override
+// applies, if any. The most specific matching site wins.
+func (p RetentionPolicy) maxAge(rawURL string) (time.Duration, string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return p.MaxAge, ""
+	}
+	host := strings.ToLower(u.Hostname())
+	age, site := p.MaxAge, ""
+	for s, a := range p.Sites {
+		if (host == s || strings.HasSuffix(host, "."+s)) && len(s) > len(site) {
+			age, site = a, s
+		}
+	}
+	return age, site
+}
+
+// retainedPage is what a retention policy knows about a page.
+type retainedPage struct {
+	ID        int64
+	URL       string
+	ScrapedAt time.Time
+	Bytes     int64
+	Pinned    bool
+}
+
+// PruneCandidate is a page that a retention policy deletes, and why.
+type PruneCandidate struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	ScrapedAt time.Time `json:"scraped_at"`
+	Bytes     int64     `json:"bytes"`
+	Reason    string    `json:"reason"`
+}
+
+// plan picks the pages to delete out of pages ordered newest first.
+func (p RetentionPolicy) plan(pages []retainedPage, now time.Time) []PruneCandidate {
+	var doomed []PruneCandidate
+	var kept int64
+	full := false
+	for _, page := range pages {
+		if page.Pinned && p.KeepPinned {
+			kept += page.Bytes
+			continue
+		}
+
+		reason := ""
+		maxAge, site := p.maxAge(page.URL)
+		switch {
+		case maxAge > 0 && now.Sub(page.ScrapedAt) > maxAge:
+			reason = "older than " + formatDays(maxAge)
+			if site != "" {
+				reason += " on " + site
+			}
+		case full || (p.MaxBytes > 0 && kept+page.Bytes > p.MaxBytes):
+			// Once past the cap, older pages go too, even if they would fit.
+			full = true
+			reason = "over the size limit"
+		}
+		if reason == "" {
+			kept += page.Bytes
+			continue
+		}
+		doomed = append(doomed, PruneCandidate{
+			ID:        page.ID,
+			URL:       page.URL,
+			ScrapedAt: page.ScrapedAt,
+			Bytes:     page.Bytes,
+			Reason:    reason,
+		})
+	}
+	return doomed
+}
+
+// PrunePlan lists the pages that Prune would delete, without deleting them.
+func (db *DB) PrunePlan(p RetentionPolicy) ([]PruneCandidate, error) {
+	rows, err := db.read.Query(`
+	SELECT id, url, scraped_at, length(CAST(title AS BLOB)) + length(CAST(content AS BLOB)), pinned
+	FROM web_data
+	ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []retainedPage
+	for rows.Next() {
+		var page retainedPage
+		var scrapeTime string
+		if err := rows.Scan(&page.ID, &page.URL, &scrapeTime, &page.Bytes, &page.Pinned); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		if page.ScrapedAt, err = timeFromDB(scrapeTime); err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return p.plan(pages, time.Now()), nil
+}
+
+// Prune deletes the pages that the policy doesn't keep, a batch at a time, and
+// returns them.
+func (db *DB) Prune(p RetentionPolicy) ([]PruneCandidate, error) {
+	doomed, err := db.PrunePlan(p)
+	if err != nil {
+		return nil, fmt.Errorf("plan: %w", err)
+	}
+	return db.prune(p, doomed)
+}
+
+// prune deletes the planned pages a batch at a time.
+func (db *DB) prune(p RetentionPolicy, doomed []PruneCandidate) ([]PruneCandidate, error) {
+	for start := 0; start < len(doomed); start += pruneBatch {
+		batch := doomed[start:min(start+pruneBatch, len(doomed))]
+		ids := make([]int64, len(batch))
+		for i, c := range batch {
+			ids[i] = c.ID
+		}
+		in, args := inList(ids)
+		query := `DELETE FROM web_data WHERE id IN ` + in
+		if p.KeepPinned {
+			// The page may have been pinned since the plan was made.
+			query += ` AND NOT pinned`
+		}
+		result, err := db.Exec(query, args...)
+		if err != nil {
+			return doomed[:start], fmt.Errorf("failed to delete: %w", err)
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			db.countEvictions("retention", n)
+		}
+		for _, c := range batch {
+			log.Info("Pruned page", "id", c.ID, "url", c.URL, "reason", c.Reason)
+		}
+		time.Sleep(pruneBatchPause)
+	}
+	return doomed, nil
+}
+
+// SetPinned pins or unpins a page.
+func (db *DB) SetPinned(id int64, pinned bool) error {
+	res, err := db.Exec(`UPDATE web_data SET pinned = ? WHERE id = ?`, pinned, id)
+	if err != nil {
+		return fmt.Errorf("failed to pin: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// runJanitor prunes the store now and every interval after. It is meant to be
+// run in the background.
+func runJanitor(store RetentionStore, p RetentionPolicy, interval time.Duration) {
+	for {
+		start := time.Now()
+		pruned, err := store.Prune(p)
+		if err != nil {
+			log.Errorf("Failed to prune pages: %v", err)
+		}
+		if len(pruned) > 0 {
+			var bytes int64
+			for _, c := range pruned {
+				bytes += c.Bytes
+			}
+			log.Infof("Pruned %d pages (%d bytes) in %v", len(pruned), bytes, time.Since(start))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// retentionFromEnv reads the retention policy from the environment.
+func retentionFromEnv() RetentionPolicy {
+	p := RetentionPolicy{
+		MaxAge:     envDuration("RETAIN_MAX_AGE", 0),
+		MaxBytes:   int64(envInt("RETAIN_MAX_MB", 0)) << 20,
+		KeepPinned: envBool("RETAIN_KEEP_PINNED", true),
+	}
+	if raw := os.Getenv("RETAIN_SITES"); raw != "" {
+		sites, err := parseRetentionSites(raw)
+		if err != nil {
+			log.Warnf("Ignoring RETAIN_SITES=%q: %v", raw, err)
+		}
+		p.Sites = sites
+	}
+	return p
+}
+
+// parseRetentionSites parses comma separated site=age pairs, such as
+// "news.ycombinator.com=7d,docs.python.org=forever".
+func parseRetentionSites(raw string) (map[string]time.Duration, error) {
+	sites := make(map[string]time.Duration)
+	for _, pair := range strings.Split(raw, ",") {
+		site, age, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || site == "" {
+			return nil, fmt.Errorf("%q is not site=age", pair)
+		}
+		site = strings.ToLower(site)
+		if age == "forever" {
+			sites[site] = 0
+			continue
+		}
+		d, err := parseDays(age)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", site, err)
+		}
+		sites[site] = d
+	}
+	return sites, nil
+}
+
+// parseDays parses a duration like time.ParseDuration, but also accepts a
+// whole number of days such as "30d".
+func parseDays(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// formatDays formats a duration as days if it is a whole number of them.
+func formatDays(d time.Duration) string {
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// retentionFromForm reads a policy to preview, starting from base and
+// overriding the rules given as form values.
+func retentionFromForm(r *http.Request, base RetentionPolicy) (RetentionPolicy, error) {
+	p := base
+	if raw := r.FormValue("max_age"); raw != "" {
+		d, err := parseDays(raw)
+		if err != nil {
+			return p, fmt.Errorf("max_age: %w", err)
+		}
+		p.MaxAge = d
+	}
+	if raw := r.FormValue("max_mb"); raw != "" {
+		mb, err := strconv.Atoi(raw)
+		if err != nil {
+			return p, fmt.Errorf("max_mb: %w", err)
+		}
+		p.MaxBytes = int64(mb) << 20
+	}
+	if raw := r.FormValue("sites"); raw != "" {
+		sites, err := parseRetentionSites(raw)
+		if err != nil {
+			return p, fmt.Errorf("sites: %w", err)
+		}
+		p.Sites = sites
+	}
+	if raw := r.FormValue("keep_pinned"); raw != "" {
+		keep, err := strconv.ParseBool(raw)
+		if err != nil {
+			return p, fmt.Errorf("keep_pinned: %w", err)
+		}
+		p.KeepPinned = keep
+	}
+	return p, nil
+}
+
+// apiRetentionPolicy is a RetentionPolicy with readable durations.
+type apiRetentionPolicy struct {
+	MaxAge     string            `json:"max_age,omitempty"`
+	MaxBytes   int64             `json:"max_bytes,omitempty"`
+	Sites      map[string]string `json:"sites,omitempty"`
+	KeepPinned bool              `json:"keep_pinned"`
+}
+
+type apiRetentionPreview struct {
+	Policy apiRetentionPolicy `json:"policy"`
+	// Total and Bytes count every page that would be deleted, Pages only the
+	// oldest of them.
+	Total int              `json:"total"`
+	Bytes int64            `json:"bytes"`
+	Pages []PruneCandidate `json:"pages"`
+}
+
+// makeRetentionPreview shows what the janitor would delete without deleting
+// anything. Form values try out other rules, see retentionFromForm.
+func makeRetentionPreview(store RetentionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := retentionFromForm(r, retention)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+
+		doomed, err := store.PrunePlan(p)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("retention preview: failed to plan: %v", err)
+			return
+		}
+
+		resp := apiRetentionPreview{
+			Policy: apiRetentionPolicy{
+				MaxBytes:   p.MaxBytes,
+				KeepPinned: p.KeepPinned,
+			},
+			Total: len(doomed),
+			Pages: doomed[max(0, len(doomed)-pageSize(limit)):],
+		}
+		if p.MaxAge > 0 {
+			resp.Policy.MaxAge = formatDays(p.MaxAge)
+		}
+		if len(p.Sites) > 0 {
+			resp.Policy.Sites = make(map[string]string)
+			for site, age := range p.Sites {
+				resp.Policy.Sites[site] = "forever"
+				if age > 0 {
+					resp.Policy.Sites[site] = formatDays(age)
+				}
+			}
+		}
+		for _, c := range doomed {
+			resp.Bytes += c.Bytes
+		}
+		writeJSON(w, resp)
+	}
+}
+
+// makePinPage pins a page, or unpins it if the form value "pinned" is false,
+// then goes back to the previous page.
+func makePinPage(store RetentionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		pinned := r.FormValue("pinned") != "false"
+		err = store.SetPinned(int64(id), pinned)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Warnf("Failed to pin page id %d: %v", id, err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		goBack(w, r)
+	}
+}
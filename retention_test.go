@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRetentionPlan(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	// Newest first, as the plan expects.
+	pages := []retainedPage{
+		{ID: 6, URL: "https://news.example.com/a", ScrapedAt: daysAgo(1), Bytes: 10},
+		{ID: 5, URL: "https://docs.example.org/b", ScrapedAt: daysAgo(3), Bytes: 10},
+		{ID: 4, URL: "https://c.com/", ScrapedAt: daysAgo(5), Bytes: 10, Pinned: true},
+		{ID: 3, URL: "https://news.example.com/d", ScrapedAt: daysAgo(10), Bytes: 10},
+		{ID: 2, URL: "https://e.com/", ScrapedAt: daysAgo(40), Bytes: 10},
+		{ID: 1, URL: "https://docs.example.org/f", ScrapedAt: daysAgo(400), Bytes: 1},
+	}
+
+	table := []struct {
+		name   string
+		policy RetentionPolicy
+		want   string
+	}{{
+		name:   "keep everything",
+		policy: RetentionPolicy{},
+		want:   "[]",
+	}, {
+		name:   "max age",
+		policy: RetentionPolicy{MaxAge: 7 * 24 * time.Hour, KeepPinned: true},
+		want:   "[3:older than 7d 2:older than 7d 1:older than 7d]",
+	}, {
+		name:   "pinned too",
+		policy: RetentionPolicy{MaxAge: 4 * 24 * time.Hour},
+		want:   "[4:older than 4d 3:older than 4d 2:older than 4d 1:older than 4d]",
+	}, {
+		name: "site overrides",
+		policy: RetentionPolicy{
+			MaxAge: 30 * 24 * time.Hour,
+			Sites: map[string]time.Duration{
+				"example.com":      0,
+				"news.example.com": 2 * 24 * time.Hour,
+				"example.org":      24 * time.Hour,
+			},
+			KeepPinned: true,
+		},
+		want: "[5:older than 1d on example.org 3:older than 2d on news.example.com 2:older than 30d 1:older than 1d on example.org]",
+	}, {
+		name:   "size cap",
+		policy: RetentionPolicy{MaxBytes: 25, KeepPinned: true},
+		// Page 1 would fit, but it is older than pages that didn't.
+		want: "[3:over the size limit 2:over the size limit 1:over the size limit]",
+	}}
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, c := range tc.policy.plan(pages, now) {
+				got = append(got, fmt.Sprintf("%d:%s", c.ID, c.Reason))
+			}
+			if fmt.Sprint(got) != tc.want {
+				t.Errorf("plan returned %v, wanted %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	mux := http.NewServeMux()
+	routes(mux, db, func(h http.Handler) http.Handler { return h })
+
+	// More old pages than a batch, older the lower their id.
+	var old []int64
+	for i := range 2*pruneBatch + 50 {
+		page := testPage(fmt.Sprintf("https://old.com/%d", i), "old", "old news")
+		page.ScrapedAt = time.Now().AddDate(0, 0, -10).Add(time.Duration(i) * time.Minute)
+		old = append(old, mustSave(t, db, page))
+	}
+	fresh := mustSave(t, db, testPage("https://new.com/", "new", "fresh news"))
+	remaining := func() []int64 {
+		t.Helper()
+		rows, err := db.read.Query(`SELECT id FROM web_data ORDER BY id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			rows.Scan(&id)
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	// The preview lists the oldest candidates.
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/retention?max_age=7d&keep_pinned=true&limit=3", nil))
+	var preview apiRetentionPreview
+	if err := json.NewDecoder(w.Body).Decode(&preview); err != nil {
+		t.Fatalf("decode preview: %v: %s", err, w.Body)
+	}
+	var previewed []int64
+	for _, c := range preview.Pages {
+		previewed = append(previewed, c.ID)
+	}
+	if want := []int64{old[2], old[1], old[0]}; preview.Total != len(old) || !slices.Equal(previewed, want) {
+		t.Errorf("preview has %d pages %v, wanted %d pages %v", preview.Total, previewed, len(old), want)
+	}
+	if remaining := remaining(); len(remaining) != len(old)+1 {
+		t.Errorf("preview deleted %d pages", len(old)+1-len(remaining))
+	}
+
+	policy := RetentionPolicy{MaxAge: 7 * 24 * time.Hour, KeepPinned: true}
+	if err := db.SetPinned(old[0], true); err != nil {
+		t.Fatalf("SetPinned: %v", err)
+	}
+	pruned, err := db.Prune(policy)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(pruned) != len(old)-1 {
+		t.Errorf("pruned %d pages, wanted %d", len(pruned), len(old)-1)
+	}
+	if got, want := remaining(), []int64{old[0], fresh}; !slices.Equal(got, want) {
+		t.Errorf("after pruning, pages %v are left, wanted %v", got, want)
+	}
+
+	// A page pinned after the plan was made is kept.
+	late := testPage("https://old.com/late", "late", "pinned late")
+	late.ScrapedAt = time.Now().AddDate(0, 0, -10)
+	lateID := mustSave(t, db, late)
+	plan, err := db.PrunePlan(policy)
+	if err != nil {
+		t.Fatalf("PrunePlan: %v", err)
+	}
+	if len(plan) != 1 || plan[0].ID != lateID {
+		t.Fatalf("plan = %+v, wanted page %d", plan, lateID)
+	}
+	if err := db.SetPinned(lateID, true); err != nil {
+		t.Fatalf("SetPinned: %v", err)
+	}
+	if _, err := db.prune(policy, plan); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if got, want := remaining(), []int64{old[0], fresh, lateID}; !slices.Equal(got, want) {
+		t.Errorf("after pruning a page pinned since the plan, pages %v are left, wanted %v", got, want)
+	}
+
+	if err := db.SetPinned(old[1], true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetPinned of a deleted page returned %v", err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/pages/%d/pin", old[1]), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("pinning a deleted page returned %d", w.Code)
+	}
+}
+
+func TestRetentionSiteCase(t *testing.T) {
+	sites, err := parseRetentionSites("Wiki.Example.com=forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := RetentionPolicy{MaxAge: 24 * time.Hour, Sites: sites}
+	if age, site := p.maxAge("https://WIKI.example.COM/Page"); age != 0 || site != "wiki.example.com" {
+		t.Errorf("maxAge = %v on %q, wanted forever on wiki.example.com", age, site)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"html/template"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/embed"
+)
+
+const (
+	embedDims    = 256
+	chunkWords   = 200
+	chunkOverlap = 50
+
+	// hybridDepth is how many results of each ranking are fused together.
+	hybridDepth = 200
+	// minSimilarity keeps pages that have nothing to do with the query out of
+	// the vector ranking, which otherwise always has hybridDepth entries.
+	minSimilarity = 0.1
+	// rrfK dampens the advantage of the very top ranks in reciprocal rank
+	// fusion. 60 is the value from the original paper.
+	rrfK = 60
+)
+
+// embedPage stores a vector for each chunk of the page. The title is
+// prepended to every chunk since it says what the whole page is about.
+func (db *DB) embedPage(id int64, safeTitle, safeContent template.HTML) error {
+	title := html.UnescapeString(string(safeTitle))
+	content := html.UnescapeString(string(safeContent))
+	model := db.Embedder.Name()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, chunk := range embed.Chunks(content, chunkWords, chunkOverlap) {
+		vec := db.Embedder.Embed(title + "\n" + chunk)
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO chunk_vectors(page_id, chunk, model, vector) VALUES (?, ?, ?, ?)`,
+			id, i, model, embed.Encode(vec)); err != nil {
+			return fmt.Errorf("insert chunk %d: %w", i, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// EmbedMissing embeds every page that has no vectors from the current
+// embedder, replacing vectors from any other embedder. It returns the number of
+// pages embedded.
+func (db *DB) EmbedMissing() (int, error) {
+	if db.Embedder == nil {
+		return 0, nil
+	}
+	model := db.Embedder.Name()
+	if _, err := db.Exec(`DELETE FROM chunk_vectors WHERE model != ?`, model); err != nil {
+		return 0, fmt.Errorf("failed to drop stale vectors: %w", err)
+	}
+
+	total := 0
+	for {
+		rows, err := db.Query(`
+		SELECT id, title, content FROM web_data
+		WHERE NOT EXISTS (SELECT 1 FROM chunk_vectors WHERE page_id = web_data.id)
+		LIMIT 50`)
+		if err != nil {
+			return total, err
+		}
+		type page struct {
+			id             int64
+			title, content template.HTML
+		}
+		var batch []page
+		for rows.Next() {
+			var p page
+			if err := rows.Scan(&p.id, db.opened("title", &p.title), db.opened("content", &p.content)); err != nil {
+				rows.Close()
+				return total, fmt.Errorf("scan: %w", err)
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		for _, p := range batch {
+			if err := db.embedPage(p.id, p.title, p.content); err != nil {
+				return total, fmt.Errorf("page %d: %w", p.id, err)
+			}
+		}
+		total += len(batch)
+	}
+}
+
+type scoredPage struct {
+	ID    int64
+	Score float32
+}
+
+// nearest finds the k pages with the chunk most similar to vec. This is a
+// brute force scan over every vector, which is fine for one person's history.
+func (db *DB) nearest(vec []float32, k int) ([]scoredPage, error) {
+	rows, err := db.read.Query(`SELECT page_id, vector FROM chunk_vectors WHERE model = ?`, db.Embedder.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	best := make(map[int64]float32)
+	for rows.Next() {
+		var id int64
+		var blob []byte
+		if err := rows.Scan(&id, &blob); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		score := embed.Dot(vec, embed.Decode(blob))
+		if prev, ok := best[id]; !ok || score > prev {
+			best[id] = score
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	pages := make([]scoredPage, 0, len(best))
+	for id, score := range best {
+		if score >= minSimilarity {
+			pages = append(pages, scoredPage{ID: id, Score: score})
+		}
+	}
+	slices.SortFunc(pages, func(a, b scoredPage) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(b.ID, a.ID))
+	})
+	return pages[:min(k, len(pages))], nil
+}
+
+// keywordIDs ranks the ids of the top n full text matches, or all of them if n
+// is negative.
+func (db *DB) keywordIDs(q SearchQuery, n int) ([]int64, error) {
+	where, args := q.where()
+	rows, err := db.read.Query(`
+	SELECT id
+	FROM web_data
+	INNER JOIN search_index ON web_data.id = search_index.rowid
+	WHERE `+where+`
+	ORDER BY bm25(search_index, ?, ?)
+	LIMIT ?`,
+		append(args, db.Weights.Content, db.Weights.Title, n)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// fuseRanks combines rankings with reciprocal rank fusion, which only looks at
+// the position of each id in each ranking. That sidesteps comparing bm25
+// scores with cosine similarities.
+func fuseRanks(rankings ...[]int64) []int64 {
+	scores := make(map[int64]float64)
+	for _, ranking := range rankings {
+		for rank, id := range ranking {
+			scores[id] += 1 / float64(rrfK+rank+1)
+		}
+	}
+	fused := make([]int64, 0, len(scores))
+	for id := range scores {
+		fused = append(fused, id)
+	}
+	slices.SortFunc(fused, func(a, b int64) int {
+		return cmp.Or(cmp.Compare(scores[b], scores[a]), cmp.Compare(b, a))
+	})
+	return fused
+}
+
+func (db *DB) hybridSearch(q SearchQuery) (SearchPage, error) {
+	ids, estimated, err := db.hybridIDs(q, hybridDepth)
+	if err != nil {
+		return SearchPage{}, err
+	}
+
+	// The fused ranking only exists in memory, so cursors are offsets into it.
+	limit := pageSize(q.Limit)
+	start := min(q.Cursor.Offset, len(ids))
+	end := min(start+limit, len(ids))
+	page := SearchPage{
+		Total:     len(ids),
+		Estimated: estimated,
+	}
+	if end < len(ids) {
+		page.Next = &Cursor{Offset: end}
+	}
+	if start > 0 {
+		page.Prev = &Cursor{Offset: max(0, start-limit)}
+	}
+	page.Results, err = db.resultsByID(q.Query, ids[start:end])
+	if err != nil {
+		return SearchPage{}, err
+	}
+	return page, nil
+}
+
+// hybridIDs ranks the matches of q by fusing the top depth keyword matches, or
+// all of them if depth is negative, with the closest vectors. It reports whether
+// there may be more keyword matches than were ranked.
+func (db *DB) hybridIDs(q SearchQuery, depth int) ([]int64, bool, error) {
+	keyword, err := db.keywordIDs(q, depth)
+	if err != nil {
+		return nil, false, fmt.Errorf("keyword ranking: %w", err)
+	}
+	nearest, err := db.nearest(db.Embedder.Embed(q.Query), hybridDepth)
+	if err != nil {
+		return nil, false, fmt.Errorf("vector ranking: %w", err)
+	}
+	semantic := make([]int64, len(nearest))
+	for i, p := range nearest {
+		semantic[i] = p.ID
+	}
+
+	// Vector matches haven't been through the filters yet.
+	ids, err := db.filterIDs(q, fuseRanks(keyword, semantic))
+	if err != nil {
+		return nil, false, fmt.Errorf("filter: %w", err)
+	}
+	return ids, depth >= 0 && len(keyword) == depth, nil
+}
+
+// filterIDs drops ids that don't pass the query's filters, keeping the order
+// of the rest. They are checked exportBatch at a time, as there can be more
+// than SQLite takes in a statement.
+func (db *DB) filterIDs(q SearchQuery, ids []int64) ([]int64, error) {
+	clause, args := q.filters()
+	keep := make(map[int64]bool)
+	for rest := ids; len(rest) > 0; {
+		batch := rest[:min(exportBatch, len(rest))]
+		rest = rest[len(batch):]
+		if err := db.passingIDs(batch, clause, args, keep); err != nil {
+			return nil, err
+		}
+	}
+	return slices.DeleteFunc(ids, func(id int64) bool { return !keep[id] }), nil
+}
+
+// passingIDs adds the ids that pass the filter clause to keep.
+func (db *DB) passingIDs(ids []int64, clause string, args []any, keep map[int64]bool) error {
+	in, inArgs := inList(ids)
+	rows, err := db.read.Query(`SELECT id FROM web_data WHERE id IN `+in+clause, append(inArgs, args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+		keep[id] = true
+	}
+	return rows.Err()
+}
+
+// backfillEmbeddings embeds pages saved before embeddings were turned on, or
+// with a different embedder. It is meant to be run in the background.
+func backfillEmbeddings(db *DB) {
+	start := time.Now()
+	n, err := db.EmbedMissing()
+	if err != nil {
+		log.Errorf("Failed to embed existing pages: %v", err)
+	}
+	if n > 0 {
+		log.Infof("Embedded %d existing pages in %v", n, time.Since(start))
+	}
+}
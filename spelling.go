@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spencer-p/palace/pkg/editdist"
+)
+
+// DidYouMean proposes a corrected version of query by replacing words that
+// match nothing with the closest term in the index vocabulary, written as a
+// word of a page it was indexed from. It returns an empty string if it has no
+// better idea.
+func (db *DB) DidYouMean(query string) (string, error) {
+	words := strings.Fields(query)
+	changed := false
+	for i, word := range words {
+		if !isPlainWord(word) {
+			continue
+		}
+		found, err := db.hasMatch(quoteFTS(word))
+		if err != nil {
+			return "", err
+		}
+		if found {
+			continue
+		}
+		term, err := db.closestTerm(strings.ToLower(word))
+		if err != nil {
+			return "", err
+		}
+		if term == "" {
+			continue
+		}
+		// The term is a porter stem, show a word it was stemmed from.
+		correction, err := db.indexedWord(term)
+		if err != nil {
+			return "", err
+		}
+		words[i] = matchCase(cmp.Or(correction, term), word)
+		changed = true
+	}
+	if !changed {
+		return "", nil
+	}
+	return strings.Join(words, " "), nil
+}
+
+// matchCase capitalizes word like the word it replaces, if that was all upper
+// case or started with a capital.
+func matchCase(word, like string) string {
+	first, _ := utf8.DecodeRuneInString(like)
+	switch {
+	case utf8.RuneCountInString(like) > 1 && like == strings.ToUpper(like):
+		return strings.ToUpper(word)
+	case unicode.IsUpper(first):
+		r, n := utf8.DecodeRuneInString(word)
+		return string(unicode.ToUpper(r)) + word[n:]
+	}
+	return word
+}
+
+// isPlainWord reports whether word is a single bareword that could be
+// misspelled, as opposed to an operator, phrase or prefix query.
+func isPlainWord(word string) bool {
+	switch word {
+	case "AND", "OR", "NOT", "NEAR":
+		return false
+	}
+	for _, r := range word {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMatch reports whether the FTS query matches any page outside the trash.
+func (db *DB) hasMatch(query string) (bool, error) {
+	var n int
+	err := db.read.QueryRow(`
+	SELECT count(*) FROM (
+		SELECT 1 FROM search_index
+		INNER JOIN web_data ON web_data.id = search_index.rowid
+		WHERE search_index MATCH ? AND `+notTrashed+`
+		LIMIT 1
+	)`, query).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("check %q: %w", query, err)
+	}
+	return n > 0, nil
+}
+
+// closestTerm finds the most common indexed term within a small edit distance
+// of word. Only terms with the same first letter and a similar length are
+// considered so that the vocabulary scan stays small. The vocabulary still
+// has the terms of pages in the trash, so terms found only there are skipped.
+//
+// The vocabulary holds porter stems, so word is also compared with its common
+// suffixes removed. This is much cruder than the real stemmer but gets
+// "cokking" close enough to "cook".
+func (db *DB) closestTerm(word string) (string, error) {
+	maxDist := 1
+	if utf8.RuneCountInString(word) >= 5 {
+		maxDist = 2
+	}
+	stem := trimSuffixes(word)
+	first, _ := utf8.DecodeRuneInString(word)
+	rows, err := db.read.Query(`
+	SELECT term, doc FROM search_vocab
+	WHERE term >= ? AND term < ?
+	AND length(term) BETWEEN ? AND ?`,
+		string(first), string(first+1),
+		utf8.RuneCountInString(stem)-maxDist, utf8.RuneCountInString(word)+maxDist,
+	)
+	if err != nil {
+		return "", fmt.Errorf("query vocabulary: %w", err)
+	}
+	defer rows.Close()
+
+	type candidate struct {
+		term       string
+		dist, docs int
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.term, &c.docs); err != nil {
+			return "", fmt.Errorf("scan vocabulary: %w", err)
+		}
+		c.dist = min(editdist.Levenshtein(word, c.term), editdist.Levenshtein(stem, c.term))
+		if c.dist <= maxDist {
+			candidates = append(candidates, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(a.dist, b.dist), cmp.Compare(b.docs, a.docs))
+	})
+	for _, c := range candidates {
+		found, err := db.termOutsideTrash(c.term)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return c.term, nil
+		}
+	}
+	return "", nil
+}
+
+// termOutsideTrash reports whether an indexed term is in any page outside the
+// trash.
+func (db *DB) termOutsideTrash(term string) (bool, error) {
+	var found bool
+	err := db.read.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1 FROM search_instances
+		INNER JOIN web_data ON web_data.id = search_instances.doc
+		WHERE term = ? AND `+notTrashed+`
+	)`, term).Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("check %q: %w", term, err)
+	}
+	return found, nil
+}
+
+var suffixes = []string{"ing", "ed", "es", "s", "ly"}
+
+func trimSuffixes(word string) string {
+	for _, suffix := range suffixes {
+		if len(word) > len(suffix)+2 && strings.HasSuffix(word, suffix) {
+			return strings.TrimSuffix(word, suffix)
+		}
+	}
+	return word
+}
+
+// quoteFTS quotes s as a single FTS5 string so that it is never interpreted as
+// query syntax.
+func quoteFTS(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
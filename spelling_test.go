@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDidYouMean(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	mustSave(t, db, testPage("https://k8s.io/", "Kubernetes guide", "running clusters"))
+	mustSave(t, db, testPage("https://food.com/", "Recipes", "cooking at home"))
+
+	table := []struct {
+		query, want string
+	}{
+		// The vocabulary has "kubernet" and "cook".
+		{"kubernetse guide", "kubernetes guide"},
+		{"cokking", "cooking"},
+		{"Cokking", "Cooking"},
+		{"KUBERNETSE", "KUBERNETES"},
+		{"kubernetes guide", ""},
+		{"xylophone", ""},
+	}
+	for _, tc := range table {
+		got, err := db.DidYouMean(tc.query)
+		if err != nil {
+			t.Fatalf("DidYouMean(%q): %v", tc.query, err)
+		}
+		if got != tc.want {
+			t.Errorf("DidYouMean(%q) = %q, wanted %q", tc.query, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Search-as-you-type for the search box. Completions refine the query, page
+// titles jump straight to the page.
+(function () {
+	const input = document.querySelector("input[data-suggest]");
+	const list = document.getElementById("suggestions");
+	if (!input || !list) {
+		return;
+	}
+	let inflight = null;
+
+	function item(text, href, className) {
+		const li = document.createElement("li");
+		const a = document.createElement("a");
+		a.textContent = text;
+		a.href = href;
+		a.className = className;
+		li.appendChild(a);
+		return li;
+	}
+
+	input.addEventListener("input", async () => {
+		if (inflight) {
+			inflight.abort();
+		}
+		inflight = new AbortController();
+		const url = input.dataset.suggest + "?q=" + encodeURIComponent(input.value);
+		let sugg;
+		try {
+			const resp = await fetch(url, {signal: inflight.signal, credentials: "same-origin"});
+			if (!resp.ok) {
+				return;
+			}
+			sugg = await resp.json();
+		} catch (e) {
+			return; // Aborted by the next keystroke.
+		}
+
+		list.replaceChildren();
+		for (const c of sugg.completions) {
+			list.appendChild(item(c, "?q=" + encodeURIComponent(c), "completion"));
+		}
+		for (const p of sugg.pages) {
+			list.appendChild(item(p.title, p.url, "page"));
+		}
+	});
+
+	// Arrow down from the search box walks into the suggestions.
+	input.addEventListener("keydown", (e) => {
+		if (e.key === "ArrowDown" && list.firstChild) {
+			e.preventDefault();
+			list.querySelector("a").focus();
+		}
+	});
+	list.addEventListener("keydown", (e) => {
+		const li = e.target.parentElement;
+		let next = null;
+		if (e.key === "ArrowDown") {
+			next = li.nextElementSibling;
+		} else if (e.key === "ArrowUp") {
+			next = li.previousElementSibling;
+			if (!next) {
+				e.preventDefault();
+				input.focus();
+				return;
+			}
+		}
+		if (next) {
+			e.preventDefault();
+			next.querySelector("a").focus();
+		}
+	});
+})();
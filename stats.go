@@ -0,0 +1,330 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// How much history the stats page breaks down.
+const (
+	statsDays    = 30
+	statsWeeks   = 12
+	statsDomains = 10
+)
+
+// Stats describes what is in the database and how big it is.
+type Stats struct {
+	Pages   int64 `json:"pages"`
+	URLs    int64 `json:"urls"`
+	Domains int64 `json:"domains"`
+	// Trashed pages are left out of everything else but the sizes.
+	Trashed int64 `json:"trashed"`
+	// Oldest and Newest are nil when there are no pages.
+	Oldest *time.Time `json:"oldest"`
+	Newest *time.Time `json:"newest"`
+
+	// PerDay and PerWeek count captures, oldest first. Weeks start on Monday.
+	PerDay  []PeriodCount `json:"per_day"`
+	PerWeek []PeriodCount `json:"per_week"`
+
+	// TopDomains have the most pages, LargestDomains the most bytes of titles
+	// and content.
+	TopDomains     []DomainStats `json:"top_domains"`
+	LargestDomains []DomainStats `json:"largest_domains"`
+
+	DatabaseBytes int64 `json:"database_bytes"`
+	IndexBytes    int64 `json:"index_bytes"`
+	WALBytes      int64 `json:"wal_bytes"`
+
+	Evictions []EvictionCount `json:"evictions"`
+}
+
+// PeriodCount is the number of captures in the day or week starting on Period.
+type PeriodCount struct {
+	Period string `json:"period"`
+	Pages  int64  `json:"pages"`
+	// Percent is Pages relative to the busiest period, to draw bars.
+	Percent int `json:"-"`
+}
+
+type DomainStats struct {
+	Domain string `json:"domain"`
+	Pages  int64  `json:"pages"`
+	Bytes  int64  `json:"bytes"`
+	Size   string `json:"-"`
+}
+
+// EvictionCount is how many pages were deleted to make room for one reason:
+// "versions" for versions beyond what a URL keeps, "retention" for retention
+// rules.
+type EvictionCount struct {
+	Reason string    `json:"reason"`
+	Pages  int64     `json:"pages"`
+	LastAt time.Time `json:"last_at"`
+}
+
+// Stats gathers the stats with a handful of aggregate queries.
+func (db *DB) Stats() (Stats, error) {
+	var s Stats
+	var oldest, newest sql.NullString
+	// The times have UTC offsets, which julianday understands and string
+	// comparison, like min and max would do, doesn't.
+	if err := db.read.QueryRow(`
+	SELECT count(*), count(DISTINCT url),
+		(SELECT scraped_at FROM web_data WHERE `+notTrashed+` ORDER BY julianday(scraped_at) LIMIT 1),
+		(SELECT scraped_at FROM web_data WHERE `+notTrashed+` ORDER BY julianday(scraped_at) DESC LIMIT 1),
+		(SELECT count(*) FROM web_data WHERE deleted_at IS NOT NULL)
+	FROM web_data
+	WHERE `+notTrashed,
+	).Scan(&s.Pages, &s.URLs, &oldest, &newest, &s.Trashed); err != nil {
+		return s, fmt.Errorf("failed to count pages: %w", err)
+	}
+	for _, t := range []struct {
+		col sql.NullString
+		dst **time.Time
+	}{{oldest, &s.Oldest}, {newest, &s.Newest}} {
+		if !t.col.Valid {
+			continue
+		}
+		parsed, err := timeFromDB(t.col.String)
+		if err != nil {
+			return s, err
+		}
+		*t.dst = &parsed
+	}
+
+	var err error
+	if s.PerDay, s.PerWeek, err = db.capturesPerPeriod(time.Now()); err != nil {
+		return s, fmt.Errorf("failed to count captures: %w", err)
+	}
+	if s.TopDomains, s.LargestDomains, s.Domains, err = db.domainStats(); err != nil {
+		return s, fmt.Errorf("failed to count domains: %w", err)
+	}
+
+	if s.DatabaseBytes, err = db.fileSize(); err != nil {
+		return s, fmt.Errorf("failed to measure database: %w", err)
+	}
+	// dbstat sums the pages of the tables FTS5 keeps the index in.
+	if err := db.read.QueryRow(`
+	SELECT coalesce(sum(pgsize), 0)
+	FROM dbstat
+	WHERE aggregate = TRUE AND name LIKE 'search\_index\_%' ESCAPE '\'`,
+	).Scan(&s.IndexBytes); err != nil {
+		return s, fmt.Errorf("failed to measure search index: %w", err)
+	}
+	file, err := db.filename()
+	if err != nil {
+		return s, err
+	}
+	if file != "" {
+		info, err := os.Stat(file + "-wal")
+		if err == nil {
+			s.WALBytes = info.Size()
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return s, fmt.Errorf("failed to measure write-ahead log: %w", err)
+		}
+	}
+
+	if s.Evictions, err = db.evictionCounts(); err != nil {
+		return s, fmt.Errorf("failed to read evictions: %w", err)
+	}
+	return s, nil
+}
+
+// capturesPerPeriod counts the captures of the last statsDays days and
+// statsWeeks weeks up to now, including periods without any.
+func (db *DB) capturesPerPeriod(now time.Time) (days, weeks []PeriodCount, err error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// Days since Monday.
+	weekday := (int(today.Weekday()) + 6) % 7
+	firstWeek := today.AddDate(0, 0, -weekday-7*(statsWeeks-1))
+	firstDay := today.AddDate(0, 0, 1-statsDays)
+	start := firstWeek
+	if firstDay.Before(start) {
+		start = firstDay
+	}
+
+	rows, err := db.read.Query(`
+	SELECT `+dayExpr+` AS day, count(*)
+	FROM web_data
+	WHERE day >= ? AND `+notTrashed+`
+	GROUP BY day`,
+		start.Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	perDay := make(map[string]int64)
+	for rows.Next() {
+		var day string
+		var n int64
+		if err := rows.Scan(&day, &n); err != nil {
+			return nil, nil, fmt.Errorf("scan: %w", err)
+		}
+		perDay[day] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for d := firstDay; !d.After(today); d = d.AddDate(0, 0, 1) {
+		day := d.Format(time.DateOnly)
+		days = append(days, PeriodCount{Period: day, Pages: perDay[day]})
+	}
+	for w := firstWeek; !w.After(today); w = w.AddDate(0, 0, 7) {
+		week := PeriodCount{Period: w.Format(time.DateOnly)}
+		for d := w; d.Before(w.AddDate(0, 0, 7)); d = d.AddDate(0, 0, 1) {
+			week.Pages += perDay[d.Format(time.DateOnly)]
+		}
+		weeks = append(weeks, week)
+	}
+	setPercents(days)
+	setPercents(weeks)
+	return days, weeks, nil
+}
+
+// setPercents sizes each period against the busiest.
+func setPercents(periods []PeriodCount) {
+	var most int64
+	for _, p := range periods {
+		most = max(most, p.Pages)
+	}
+	if most == 0 {
+		return
+	}
+	for i := range periods {
+		periods[i].Percent = int(periods[i].Pages * 100 / most)
+	}
+}
+
+// domainStats returns the statsDomains domains with the most pages and with
+// the most bytes, and how many domains there are.
+func (db *DB) domainStats() (top, largest []DomainStats, n int64, err error) {
+	rows, err := db.read.Query(`
+	SELECT ` + hostExpr + ` AS host, count(*), sum(length(CAST(title AS BLOB)) + length(CAST(content AS BLOB)))
+	FROM web_data
+	WHERE ` + notTrashed + `
+	GROUP BY host`)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer rows.Close()
+	var all []DomainStats
+	for rows.Next() {
+		var d DomainStats
+		if err := rows.Scan(&d.Domain, &d.Pages, &d.Bytes); err != nil {
+			return nil, nil, 0, fmt.Errorf("scan: %w", err)
+		}
+		d.Size = formatBytes(d.Bytes)
+		all = append(all, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, 0, err
+	}
+
+	slices.SortFunc(all, func(a, b DomainStats) int {
+		return cmp.Or(cmp.Compare(b.Pages, a.Pages), cmp.Compare(a.Domain, b.Domain))
+	})
+	top = append([]DomainStats(nil), all[:min(statsDomains, len(all))]...)
+	slices.SortFunc(all, func(a, b DomainStats) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Domain, b.Domain))
+	})
+	largest = all[:min(statsDomains, len(all))]
+	return top, largest, int64(len(all)), nil
+}
+
+// countEvictions adds n pages deleted for the reason to the running totals.
+// Failing to count is logged rather than failing the deletion.
+func (db *DB) countEvictions(reason string, n int64) {
+	if n <= 0 {
+		return
+	}
+	if _, err := db.Exec(`
+	INSERT INTO evictions(reason, pages, last_at) VALUES (?, ?, ?)
+	ON CONFLICT(reason) DO UPDATE SET pages = pages + excluded.pages, last_at = excluded.last_at`,
+		reason, n, time.Now().Format(ISO8601TZ),
+	); err != nil {
+		log.Warnf("Failed to count %d evictions for %s: %v", n, reason, err)
+	}
+}
+
+func (db *DB) evictionCounts() ([]EvictionCount, error) {
+	rows, err := db.read.Query(`SELECT reason, pages, last_at FROM evictions ORDER BY reason`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []EvictionCount
+	for rows.Next() {
+		var c EvictionCount
+		var lastAt string
+		if err := rows.Scan(&c.Reason, &c.Pages, &lastAt); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		if c.LastAt, err = timeFromDB(lastAt); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// formatBytes writes a size in bytes with a binary unit, like "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func makeStats(store StatsStore) func(w http.ResponseWriter, r *http.Request) {
+	statsTemplate := template.Must(template.ParseFS(staticContent, "static/stats.template.html"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := store.Stats()
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("stats: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if err := statsTemplate.Execute(w, map[string]any{
+			"Root":     prefix,
+			"Stats":    s,
+			"Database": formatBytes(s.DatabaseBytes),
+			"Index":    formatBytes(s.IndexBytes),
+			"WAL":      formatBytes(s.WALBytes),
+		}); err != nil {
+			log.Errorf("failed to render stats: %v", err)
+		}
+	}
+}
+
+func makeStatsAPI(store StatsStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := store.Stats()
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("stats api: %v", err)
+			return
+		}
+		writeJSON(w, s)
+	}
+}
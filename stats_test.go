@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.SaveVersionRule(VersionRule{Pattern: "example.com", Keep: 1}); err != nil {
+		t.Fatalf("SaveVersionRule: %v", err)
+	}
+	lastWeek := testPage("https://other.org/old", "old", "from last week")
+	lastWeek.ScrapedAt = time.Now().AddDate(0, 0, -7)
+	mustSave(t, db, lastWeek)
+	mustSave(t, db, testPage("https://example.com/", "one", "first version"))
+	mustSave(t, db, testPage("https://example.com/", "two", "second version"))
+	mustSave(t, db, testPage("https://other.org/a", "a", "a much longer page than the others"))
+	mustSave(t, db, testPage("https://other.org/b", "b", "b"))
+
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if s.Pages != 4 || s.URLs != 4 || s.Domains != 2 {
+		t.Errorf("got %d pages of %d URLs on %d domains, wanted 4, 4 and 2", s.Pages, s.URLs, s.Domains)
+	}
+	if s.Oldest == nil || time.Since(*s.Oldest) < 6*24*time.Hour || s.Newest == nil || time.Since(*s.Newest) > time.Minute {
+		t.Errorf("got captures from %v to %v", s.Oldest, s.Newest)
+	}
+	if len(s.PerDay) != statsDays || len(s.PerWeek) != statsWeeks {
+		t.Fatalf("got %d days and %d weeks", len(s.PerDay), len(s.PerWeek))
+	}
+	if today := s.PerDay[statsDays-1]; today.Pages != 3 || today.Percent != 100 {
+		t.Errorf("today = %+v, wanted 3 pages", today)
+	}
+	var weekly int64
+	for _, w := range s.PerWeek {
+		weekly += w.Pages
+	}
+	if weekly != 4 {
+		t.Errorf("got %d pages over the weeks, wanted 4", weekly)
+	}
+	if len(s.TopDomains) != 2 || s.TopDomains[0].Domain != "other.org" || s.TopDomains[0].Pages != 3 {
+		t.Errorf("top domains = %+v", s.TopDomains)
+	}
+	if len(s.LargestDomains) != 2 || s.LargestDomains[0].Domain != "other.org" || s.LargestDomains[1].Bytes != int64(len("two")+len("second version")) {
+		t.Errorf("largest domains = %+v", s.LargestDomains)
+	}
+	if s.DatabaseBytes == 0 || s.IndexBytes == 0 || s.IndexBytes >= s.DatabaseBytes {
+		t.Errorf("got %d bytes of index in %d of database", s.IndexBytes, s.DatabaseBytes)
+	}
+	if len(s.Evictions) != 1 || s.Evictions[0].Reason != "versions" || s.Evictions[0].Pages != 1 {
+		t.Errorf("evictions = %+v", s.Evictions)
+	}
+}
+
+// TestStatsOffsets checks that the oldest and newest captures are found by
+// time, not by how their times sort as text.
+func TestStatsOffsets(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	// 2023-12-31 20:00 UTC, though it reads as the later day.
+	east := testPage("https://east.com/", "east", "far east")
+	east.ScrapedAt = time.Date(2024, 1, 1, 10, 0, 0, 0, time.FixedZone("", 14*60*60))
+	// 2024-01-01 10:00 UTC.
+	west := testPage("https://west.com/", "west", "out west")
+	west.ScrapedAt = time.Date(2024, 1, 1, 5, 0, 0, 0, time.FixedZone("", -5*60*60))
+	mustSave(t, db, west)
+	mustSave(t, db, east)
+
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if s.Oldest == nil || !s.Oldest.Equal(east.ScrapedAt) || s.Newest == nil || !s.Newest.Equal(west.ScrapedAt) {
+		t.Errorf("got captures from %v to %v, wanted %v to %v", s.Oldest, s.Newest, east.ScrapedAt, west.ScrapedAt)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	table := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tc := range table {
+		if got := formatBytes(tc.n); got != tc.want {
+			t.Errorf("formatBytes(%d) = %q, wanted %q", tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"time"
+)
+
+// ErrNotFound is returned when there is no page with the given id.
+var ErrNotFound = errors.New("page not found")
+
+// Store keeps pages and searches them. DB is the real one, backed by SQLite.
+//
+// Features that not every store can offer have their own interfaces below.
+// Handlers for them are only served if the store implements them.
+type Store interface {
+	Save(col DataColumn) (int64, error)
+	Search(q SearchQuery) (SearchPage, error)
+	// Fetch returns ErrNotFound if there is no page with the id.
+	Fetch(id int64) (SearchResult, error)
+	// Delete moves the page to the trash if the store is a TrashStore, and
+	// deletes it for good otherwise.
+	Delete(id int64) error
+	History(from Cursor, limit int) (SearchPage, error)
+}
+
+// Speller corrects misspelled queries.
+type Speller interface {
+	DidYouMean(query string) (string, error)
+}
+
+// Suggester completes partly typed queries.
+type Suggester interface {
+	Suggest(query string, limit int) (Suggestions, error)
+}
+
+// Highlighter marks the matches of a query in a page.
+type Highlighter interface {
+	Highlight(id int64, query string) (template.HTML, int, error)
+}
+
+// RelatedFinder finds pages like a given one.
+type RelatedFinder interface {
+	Related(id int64, n int) ([]SearchResult, error)
+}
+
+// QuoteFinder finds pages containing a passage.
+type QuoteFinder interface {
+	FindQuote(passage string, limit int) ([]QuoteMatch, error)
+}
+
+// Exporter lists every match of a search.
+type Exporter interface {
+	Export(q SearchQuery, yield func(SearchResult) error) error
+}
+
+// AlertStore keeps saved searches and the pages that matched them.
+type AlertStore interface {
+	SaveSearch(s SavedSearch) (int64, error)
+	DeleteSearch(id int64) error
+	SavedSearches() ([]SavedSearch, error)
+	MatchSavedSearches(id int64, col DataColumn) ([]Alert, error)
+	Alerts(limit int) ([]Alert, error)
+	UnseenAlerts() (int, error)
+	MarkAlertsSeen() error
+}
+
+// TimelineStore groups pages by when they were captured.
+type TimelineStore interface {
+	ActiveDays(before string, n int) ([]string, error)
+	AdjacentDays(date string) (prev, next string, err error)
+	Timeline(dates []string) ([]TimelineDay, error)
+	Activity(start, end string) (map[string]int, error)
+}
+
+// RetentionStore deletes pages by retention rules, sparing pinned pages.
+type RetentionStore interface {
+	PrunePlan(p RetentionPolicy) ([]PruneCandidate, error)
+	Prune(p RetentionPolicy) ([]PruneCandidate, error)
+	// SetPinned returns ErrNotFound if there is no page with the id.
+	SetPinned(id int64, pinned bool) error
+}
+
+// VersionStore keeps rules for how many versions of each URL to keep.
+type VersionStore interface {
+	VersionRules() ([]VersionRule, error)
+	SaveVersionRule(r VersionRule) (int64, error)
+	DeleteVersionRule(id int64) error
+	// ApplyVersionRules evicts versions saved before the rules changed.
+	ApplyVersionRules() (int64, error)
+}
+
+// Maintainer runs maintenance on the index and database and keeps the results.
+type Maintainer interface {
+	// Maintain returns ErrUnknownOp if op is not in maintenanceOps.
+	Maintain(op string) (MaintenanceRun, error)
+	MaintenanceRuns(limit int) ([]MaintenanceRun, error)
+}
+
+// Snapshotter copies the database to a file for backups.
+type Snapshotter interface {
+	Snapshot(path string) error
+}
+
+// TrashStore keeps deleted pages out of sight until they are restored or
+// purged.
+type TrashStore interface {
+	Trash(limit int) ([]TrashedPage, error)
+	// Restore and Purge return ErrNotFound if the page isn't in the trash.
+	Restore(id int64) error
+	Purge(id int64) error
+	// PurgeTrash purges the pages deleted before a time and returns how many
+	// there were.
+	PurgeTrash(before time.Time) (int64, error)
+}
+
+// StatsStore describes what is stored and how much room it takes.
+type StatsStore interface {
+	Stats() (Stats, error)
+}
+
+// DB implements everything.
+var _ interface {
+	Store
+	Speller
+	Suggester
+	Highlighter
+	RelatedFinder
+	QuoteFinder
+	Exporter
+	AlertStore
+	TimelineStore
+	RetentionStore
+	VersionStore
+	Maintainer
+	Snapshotter
+	StatsStore
+	TrashStore
+} = (*DB)(nil)
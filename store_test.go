@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+		if err != nil {
+			t.Fatalf("NewDB: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+}
+
+// TestEncryptedDB runs against a database that encrypts pages, with the
+// contentless search index that needs.
+func TestEncryptedDB(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return newEncryptedDB(t, filepath.Join(t.TempDir(), "palace.db"), testKey(1))
+	})
+}
+
+// TestPGStore runs against the Postgres database in PALACE_TEST_DB_URL, which
+// it empties before each test.
+func TestPGStore(t *testing.T) {
+	url := os.Getenv("PALACE_TEST_DB_URL")
+	if url == "" {
+		t.Skip("PALACE_TEST_DB_URL is not set")
+	}
+	testStore(t, func(t *testing.T) Store {
+		pg, err := NewPGStore(url)
+		if err != nil {
+			t.Fatalf("NewPGStore: %v", err)
+		}
+		t.Cleanup(func() { pg.Close() })
+		if _, err := pg.Exec(`TRUNCATE web_data RESTART IDENTITY`); err != nil {
+			t.Fatalf("truncate: %v", err)
+		}
+		return pg
+	})
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, func(*testing.T) Store { return NewMemStore() })
+}
+
+func testPage(url, title, content string) DataColumn {
+	return DataColumn{
+		ScrapedAt:   time.Now(),
+		URL:         url,
+		SafeTitle:   template.HTML(html.EscapeString(title)),
+		SafeContent: template.HTML(html.EscapeString(content)),
+	}
+}
+
+func mustSave(t *testing.T, store Store, col DataColumn) int64 {
+	t.Helper()
+	id, err := store.Save(col)
+	if err != nil {
+		t.Fatalf("Save(%q): %v", col.URL, err)
+	}
+	return id
+}
+
+func resultURLs(results []SearchResult) []string {
+	urls := make([]string, len(results))
+	for i, r := range results {
+		urls[i] = r.URL
+	}
+	return urls
+}
+
+// testStore checks the behaviour that every Store implementation must share.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("fetch", func(t *testing.T) {
+		store := newStore(t)
+		id := mustSave(t, store, testPage("https://a.com/", "Tom & Jerry", "a cat and a mouse"))
+
+		got, err := store.Fetch(id)
+		if err != nil {
+			t.Fatalf("Fetch(%d): %v", id, err)
+		}
+		if got.ID != int(id) || got.URL != "https://a.com/" || got.SafeTitle != "Tom &amp; Jerry" || got.SafeContent != "a cat and a mouse" {
+			t.Errorf("Fetch(%d) returned %+v", id, got)
+		}
+		if _, err := store.Fetch(id + 100); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Fetch of a missing page returned %v, wanted ErrNotFound", err)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		store := newStore(t)
+		mustSave(t, store, testPage("https://a.com/body", "Cooking", "all about kubernetes"))
+		mustSave(t, store, testPage("https://b.com/title", "Kubernetes operators", "writing controllers"))
+		mustSave(t, store, testPage("https://c.com/none", "Gardening", "tomatoes"))
+
+		table := []struct {
+			q    SearchQuery
+			want []string
+		}{{
+			q:    SearchQuery{Query: "kubernetes"},
+			want: []string{"https://b.com/title", "https://a.com/body"},
+		}, {
+			q:    SearchQuery{Query: "kubernetes", Site: "a.com"},
+			want: []string{"https://a.com/body"},
+		}, {
+			q:    SearchQuery{Query: "kubernetes", Month: "2001-01"},
+			want: []string{},
+		}, {
+			q:    SearchQuery{Query: "tomatoes"},
+			want: []string{"https://c.com/none"},
+		}, {
+			q:    SearchQuery{Query: "nothing"},
+			want: []string{},
+		}}
+		for _, tc := range table {
+			t.Run(fmt.Sprintf("%+v", tc.q), func(t *testing.T) {
+				page, err := store.Search(tc.q)
+				if err != nil {
+					t.Fatalf("Search: %v", err)
+				}
+				got := resultURLs(page.Results)
+				if fmt.Sprint(got) != fmt.Sprint(tc.want) || page.Total != len(tc.want) {
+					t.Errorf("Search returned %v (total %d), wanted %v", got, page.Total, tc.want)
+				}
+			})
+		}
+	})
+
+	t.Run("search pages", func(t *testing.T) {
+		store := newStore(t)
+		for i := range 7 {
+			mustSave(t, store, testPage(fmt.Sprintf("https://a.com/%d", i), "Page", "common words"))
+		}
+
+		seen := make(map[string]bool)
+		q := SearchQuery{Query: "common", Limit: 3}
+		var pages []SearchPage
+		for {
+			page, err := store.Search(q)
+			if err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			if page.Total != 7 {
+				t.Errorf("page %d has total %d, wanted 7", len(pages), page.Total)
+			}
+			for _, url := range resultURLs(page.Results) {
+				if seen[url] {
+					t.Errorf("%s is on more than one page", url)
+				}
+				seen[url] = true
+			}
+			pages = append(pages, page)
+			if page.Next == nil {
+				break
+			}
+			q.Cursor = *page.Next
+		}
+		if len(pages) != 3 || len(seen) != 7 {
+			t.Fatalf("got %d pages with %d results, wanted 3 with 7", len(pages), len(seen))
+		}
+
+		// Going back from the last page gets the middle page again.
+		q.Cursor = *pages[2].Prev
+		back, err := store.Search(q)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if got, want := resultURLs(back.Results), resultURLs(pages[1].Results); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("previous page is %v, wanted %v", got, want)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store := newStore(t)
+		id := mustSave(t, store, testPage("https://a.com/", "Gone", "soon deleted"))
+		if err := store.Delete(id); err != nil {
+			t.Fatalf("Delete(%d): %v", id, err)
+		}
+		if _, err := store.Fetch(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Fetch after delete returned %v, wanted ErrNotFound", err)
+		}
+		page, err := store.Search(SearchQuery{Query: "deleted"})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(page.Results) != 0 {
+			t.Errorf("Search after delete returned %v", resultURLs(page.Results))
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		store := newStore(t)
+		for i := range 5 {
+			mustSave(t, store, testPage(fmt.Sprintf("https://a.com/%d", i), "Page", "text"))
+		}
+
+		first, err := store.History(Cursor{}, 2)
+		if err != nil {
+			t.Fatalf("History: %v", err)
+		}
+		if got := resultURLs(first.Results); fmt.Sprint(got) != "[https://a.com/4 https://a.com/3]" {
+			t.Errorf("first page of history is %v, wanted the newest two", got)
+		}
+		if first.Total != 5 || first.Next == nil || first.Prev != nil {
+			t.Fatalf("first page has total %d, next %v, prev %v", first.Total, first.Next, first.Prev)
+		}
+
+		second, err := store.History(*first.Next, 2)
+		if err != nil {
+			t.Fatalf("History: %v", err)
+		}
+		if got := resultURLs(second.Results); fmt.Sprint(got) != "[https://a.com/2 https://a.com/1]" {
+			t.Errorf("second page of history is %v", got)
+		}
+		if second.Prev == nil {
+			t.Fatalf("second page has no previous page")
+		}
+		back, err := store.History(*second.Prev, 2)
+		if err != nil {
+			t.Fatalf("History: %v", err)
+		}
+		if got, want := resultURLs(back.Results), resultURLs(first.Results); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("going back got %v, wanted %v", got, want)
+		}
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		store := newStore(t)
+		var ids []int64
+		for i := range 7 {
+			ids = append(ids, mustSave(t, store, testPage("https://a.com/", "Page", fmt.Sprintf("version %d", i))))
+		}
+		page, err := store.History(Cursor{}, 0)
+		if err != nil {
+			t.Fatalf("History: %v", err)
+		}
+		if page.Total != 5 {
+			t.Errorf("kept %d versions, wanted 5", page.Total)
+		}
+		if _, err := store.Fetch(ids[0]); !errors.Is(err, ErrNotFound) {
+			t.Errorf("oldest version was not evicted: %v", err)
+		}
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/log"
+)
+
+// Suggestions are completions for a partially typed query.
+type Suggestions struct {
+	// Completions are the query with its last word completed from the index
+	// vocabulary, most common first.
+	Completions []string `json:"completions"`
+	// Pages have titles matching the query.
+	Pages []SuggestedPage `json:"pages"`
+}
+
+type SuggestedPage struct {
+	ID    int    `json:"id"`
+	URL   string `json:"url"`
+	Title string `json:"title"`
+}
+
+// minSuggestPrefix is the shortest word worth completing. The index keeps
+// prefix indexes for 2 and 3 characters, anything shorter is a table scan.
+const minSuggestPrefix = 2
+
+// Suggest completes a partially typed query. It is meant to be called on every
+// keystroke, so it only looks at the vocabulary and page titles.
+func (db *DB) Suggest(query string, limit int) (Suggestions, error) {
+	sugg := Suggestions{
+		Completions: []string{},
+		Pages:       []SuggestedPage{},
+	}
+	words := strings.Fields(query)
+	if len(words) == 0 || strings.HasSuffix(query, " ") {
+		return sugg, nil
+	}
+	last := strings.ToLower(words[len(words)-1])
+	if !isPlainWord(last) || utf8.RuneCountInString(last) < minSuggestPrefix {
+		return sugg, nil
+	}
+
+	var err error
+	sugg.Completions, err = db.completeTerm(words[:len(words)-1], last, limit)
+	if err != nil {
+		return sugg, err
+	}
+	sugg.Pages, err = db.suggestPages(words, limit)
+	if err != nil {
+		return sugg, err
+	}
+	return sugg, nil
+}
+
+// completeTerm completes prefix from the index vocabulary, most common first.
+// The vocabulary holds porter stems, which often aren't words ("kubernet"), so
+// each is shown as a word of a page that was stemmed to it.
+func (db *DB) completeTerm(before []string, prefix string, limit int) ([]string, error) {
+	// Some terms may have no word to show, so look at a few more.
+	rows, err := db.read.Query(`
+	SELECT term FROM search_vocab
+	WHERE term >= ? AND term < ?
+	ORDER BY doc DESC
+	LIMIT ?`,
+		prefix, prefix+"\U0010FFFF", 2*limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query vocabulary: %w", err)
+	}
+	var terms []string
+	for rows.Next() {
+		var term string
+		if err := rows.Scan(&term); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan vocabulary: %w", err)
+		}
+		terms = append(terms, term)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	completions := []string{}
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if len(completions) == limit {
+			break
+		}
+		word, err := db.indexedWord(term)
+		if err != nil {
+			return nil, err
+		}
+		if word == "" || seen[word] {
+			continue
+		}
+		seen[word] = true
+		completions = append(completions, strings.Join(slices.Concat(before, []string{word}), " "))
+	}
+	return completions, nil
+}
+
+// indexedWord finds a word of a page outside the trash that the index stemmed
+// to term, lower cased, or returns an empty string if there is none.
+func (db *DB) indexedWord(term string) (string, error) {
+	var id int64
+	var col string
+	var offset int
+	err := db.read.QueryRow(`
+	SELECT doc, col, offset FROM search_instances
+	INNER JOIN web_data ON web_data.id = search_instances.doc
+	WHERE term = ? AND `+notTrashed+`
+	LIMIT 1`,
+		term,
+	).Scan(&id, &col, &offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("find %q: %w", term, err)
+	}
+	if col != "title" && col != "content" {
+		return "", fmt.Errorf("find %q: unexpected column %q", term, col)
+	}
+
+	var safe template.HTML
+	err = db.read.QueryRow(`SELECT `+col+` FROM web_data WHERE id = ?`, id).Scan(db.opened(col, &safe))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read %s of page %d: %w", col, id, err)
+	}
+	return strings.ToLower(nthToken(string(safe), offset)), nil
+}
+
+// nthToken returns the nth token of escaped text, counting from zero the way
+// the unicode61 tokenizer splits it, or an empty string if there are fewer.
+func nthToken(safe string, n int) string {
+	isTokenChar := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.In(r, unicode.Co, unicode.Mn)
+	}
+	for i := 0; ; i++ {
+		start := strings.IndexFunc(safe, isTokenChar)
+		if start < 0 {
+			return ""
+		}
+		safe = safe[start:]
+		end := strings.IndexFunc(safe, func(r rune) bool { return !isTokenChar(r) })
+		if end < 0 {
+			end = len(safe)
+		}
+		if i == n {
+			return safe[:end]
+		}
+		safe = safe[end:]
+	}
+}
+
+// suggestPages finds pages whose title contains every word, treating the last
+// one as a prefix. Only the best match for each URL is returned.
+func (db *DB) suggestPages(words []string, limit int) ([]SuggestedPage, error) {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = quoteFTS(w)
+	}
+	match := fmt.Sprintf("title : (%s *)", strings.Join(quoted, " "))
+
+	rows, err := db.read.Query(`
+	SELECT id, url, web_data.title
+	FROM web_data
+	INNER JOIN search_index ON web_data.id = search_index.rowid
+	WHERE search_index MATCH ? AND `+notTrashed+`
+	ORDER BY rank, id DESC
+	LIMIT 100`,
+		match,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query titles: %w", err)
+	}
+	defer rows.Close()
+
+	pages := []SuggestedPage{}
+	seen := make(map[string]bool)
+	for rows.Next() && len(pages) < limit {
+		var p SuggestedPage
+		var safeTitle template.HTML
+		if err := rows.Scan(&p.ID, &p.URL, db.opened("title", &safeTitle)); err != nil {
+			return nil, fmt.Errorf("scan titles: %w", err)
+		}
+		if seen[p.URL] {
+			continue
+		}
+		seen[p.URL] = true
+		p.Title = html.UnescapeString(string(safeTitle))
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+func makeSuggest(store Suggester) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.FormValue("q")
+		sugg, err := store.Suggest(query, 8)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("suggest: failed to query for %q: %v", query, err)
+			return
+		}
+
+		writeJSON(w, sugg)
+	}
+}
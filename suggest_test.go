@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		var key []byte
+		if encrypted {
+			key = testKey(1)
+		}
+		db := newEncryptedDB(t, filepath.Join(t.TempDir(), "palace.db"), key)
+		mustSave(t, db, testPage("https://k8s.io/", "Kubernetes guide", "running kubernetes clusters"))
+		mustSave(t, db, testPage("https://k8s.io/kubectl", "Kubectl cheatsheet", "commands"))
+		mustSave(t, db, testPage("https://k8s.io/kubelet", "Kubelet internals", "the node agent"))
+		mustSave(t, db, testPage("https://happy.com/", "Happy days", "sunshine"))
+
+		table := []struct {
+			query           string
+			wantCompletions []string
+			wantPages       []string
+		}{
+			{"kube", []string{"kubectl", "kubelet", "kubernetes"}, []string{"Kubectl cheatsheet", "Kubelet internals", "Kubernetes guide"}},
+			{"guide kube", []string{"guide kubectl", "guide kubelet", "guide kubernetes"}, []string{"Kubernetes guide"}},
+			// The vocabulary has "happi".
+			{"happ", []string{"happy"}, []string{"Happy days"}},
+			{"kube ", nil, nil},
+		}
+		for _, tc := range table {
+			sugg, err := db.Suggest(tc.query, 8)
+			if err != nil {
+				t.Fatalf("Suggest(%q): %v", tc.query, err)
+			}
+			slices.Sort(sugg.Completions)
+			if !slices.Equal(sugg.Completions, tc.wantCompletions) {
+				t.Errorf("encrypted=%v: Suggest(%q) completed %q, wanted %q", encrypted, tc.query, sugg.Completions, tc.wantCompletions)
+			}
+			var titles []string
+			for _, p := range sugg.Pages {
+				titles = append(titles, p.Title)
+			}
+			slices.Sort(titles)
+			if !slices.Equal(titles, tc.wantPages) {
+				t.Errorf("encrypted=%v: Suggest(%q) found %q, wanted %q", encrypted, tc.query, titles, tc.wantPages)
+			}
+		}
+	}
+}
+
+func TestNthToken(t *testing.T) {
+	table := []struct {
+		safe string
+		n    int
+		want string
+	}{
+		{"Kubernetes guide", 0, "Kubernetes"},
+		{"Kubernetes guide", 1, "guide"},
+		{"Kubernetes guide", 2, ""},
+		{"Tom &amp; Jerry's café", 1, "amp"},
+		{"Tom &amp; Jerry's café", 3, "s"},
+		{"Tom &amp; Jerry's café", 4, "café"},
+	}
+	for _, tc := range table {
+		if got := nthToken(tc.safe, tc.n); got != tc.want {
+			t.Errorf("nthToken(%q, %d) = %q, wanted %q", tc.safe, tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/prettytime"
+)
+
+// dayExpr and hourExpr extract the local date and hour from
+// web_data.scraped_at, like monthExpr.
+const (
+	dayExpr  = `substr(scraped_at, 1, 10)`
+	hourExpr = `substr(scraped_at, 12, 2)`
+)
+
+// timelineDays is the number of days with captures shown on a timeline page.
+const timelineDays = 7
+
+// TimelineDay is every capture on one date, grouped by hour.
+type TimelineDay struct {
+	Date  string
+	Count int
+	Hours []TimelineHour
+}
+
+type TimelineHour struct {
+	Hour  string
+	Pages []SearchResult
+}
+
+// ActiveDays lists up to n dates with captures before the given date, newest
+// first. An empty date means today and earlier.
+func (db *DB) ActiveDays(before string, n int) ([]string, error) {
+	if before == "" {
+		before = "9999-99-99"
+	}
+	rows, err := db.read.Query(`
+	SELECT DISTINCT `+dayExpr+` AS day
+	FROM web_data
+	WHERE day < ? AND `+notTrashed+`
+	ORDER BY day DESC
+	LIMIT ?`,
+		before, n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []string
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+// AdjacentDays finds the closest dates with captures before and after date.
+// Either is empty if there is none.
+func (db *DB) AdjacentDays(date string) (prev, next string, err error) {
+	var p, n sql.NullString
+	err = db.read.QueryRow(`
+	SELECT
+		(SELECT max(`+dayExpr+`) FROM web_data WHERE `+dayExpr+` < ? AND `+notTrashed+`),
+		(SELECT min(`+dayExpr+`) FROM web_data WHERE `+dayExpr+` > ? AND `+notTrashed+`)`,
+		date, date,
+	).Scan(&p, &n)
+	return p.String, n.String, err
+}
+
+// Timeline loads the captures on each of the dates, in the order given. Within
+// a day, captures are in the order they happened.
+func (db *DB) Timeline(dates []string) ([]TimelineDay, error) {
+	if len(dates) == 0 {
+		return nil, nil
+	}
+	in, args := inList(dates)
+	rows, err := db.read.Query(`
+	SELECT id, url, scraped_at, title, `+dayExpr+`, `+hourExpr+`
+	FROM web_data
+	WHERE `+dayExpr+` IN `+in+` AND `+notTrashed+`
+	ORDER BY scraped_at, id`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	byDate := make(map[string]*TimelineDay)
+	for rows.Next() {
+		var r SearchResult
+		var scrapeTime, day, hour string
+		if err := rows.Scan(&r.ID, &r.URL, &scrapeTime, db.opened("title", &r.SafeTitle), &day, &hour); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		t, err := timeFromDB(scrapeTime)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", r.ID, err)
+		}
+		r.ScrapedAt = t
+		r.ScrapedAgo = prettytime.DurationBetween(now, t)
+
+		d, ok := byDate[day]
+		if !ok {
+			d = &TimelineDay{Date: day}
+			byDate[day] = d
+		}
+		if len(d.Hours) == 0 || d.Hours[len(d.Hours)-1].Hour != hour {
+			d.Hours = append(d.Hours, TimelineHour{Hour: hour})
+		}
+		h := &d.Hours[len(d.Hours)-1]
+		h.Pages = append(h.Pages, r)
+		d.Count++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	days := make([]TimelineDay, 0, len(dates))
+	for _, date := range dates {
+		if d, ok := byDate[date]; ok {
+			days = append(days, *d)
+		}
+	}
+	return days, nil
+}
+
+// Activity counts the captures on each date from start to end inclusive.
+func (db *DB) Activity(start, end string) (map[string]int, error) {
+	rows, err := db.read.Query(`
+	SELECT `+dayExpr+` AS day, count(*)
+	FROM web_data
+	WHERE day BETWEEN ? AND ? AND `+notTrashed+`
+	GROUP BY day`,
+		start, end,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var day string
+		var n int
+		if err := rows.Scan(&day, &n); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		counts[day] = n
+	}
+	return counts, rows.Err()
+}
+
+// calendarDay is one cell of the activity heatmap.
+type calendarDay struct {
+	Date  string
+	Count int
+	// Level is 0 for no captures and 1 to 4 for increasing activity.
+	Level int
+	// Outside marks padding before the start or after the end of the range.
+	Outside bool
+}
+
+// calendarRows lays the dates from start to end out in the rows of a heatmap,
+// one row per weekday and one column per week.
+func calendarRows(counts map[string]int, start, end time.Time) [7][]calendarDay {
+	busiest := 0
+	for _, n := range counts {
+		busiest = max(busiest, n)
+	}
+
+	var rows [7][]calendarDay
+	day := start.AddDate(0, 0, -int(start.Weekday()))
+	for !day.After(end) || day.Weekday() != time.Sunday {
+		date := day.Format(time.DateOnly)
+		cell := calendarDay{
+			Date:    date,
+			Count:   counts[date],
+			Outside: day.Before(start) || day.After(end),
+		}
+		if cell.Count > 0 {
+			cell.Level = 1 + 3*(cell.Count-1)/max(1, busiest-1)
+		}
+		rows[day.Weekday()] = append(rows[day.Weekday()], cell)
+		day = day.AddDate(0, 0, 1)
+	}
+	return rows
+}
+
+// parseDate checks that date is formatted like 2006-01-02.
+func parseDate(date string) (time.Time, error) {
+	t, err := time.ParseInLocation(time.DateOnly, date, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("bad date %q, want YYYY-MM-DD", date)
+	}
+	return t, nil
+}
+
+func makeTimeline(store TimelineStore) func(w http.ResponseWriter, r *http.Request) {
+	timelineTemplate := template.Must(template.ParseFS(staticContent, "static/timeline.template.html"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The date picker submits a form value, but days have their own URLs.
+		if date := r.FormValue("date"); date != "" && r.PathValue("date") == "" {
+			http.Redirect(w, r, prefix+"/timeline/"+url.PathEscape(date), http.StatusFound)
+			return
+		}
+
+		data := map[string]any{
+			"Root": prefix,
+		}
+		var dates []string
+		var err error
+		if date := r.PathValue("date"); date != "" {
+			// One day and links to its neighbours.
+			if _, err := parseDate(date); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			dates = []string{date}
+			prev, next, err := store.AdjacentDays(date)
+			if err != nil {
+				http.Error(w, "Failed to query database", http.StatusInternalServerError)
+				log.Infof("timeline: failed to find days around %s: %v", date, err)
+				return
+			}
+			data["Date"], data["PrevDay"], data["NextDay"] = date, prev, next
+		} else {
+			// The most recent days, optionally before some date.
+			before := r.FormValue("before")
+			if before != "" {
+				if _, err := parseDate(before); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			dates, err = store.ActiveDays(before, timelineDays+1)
+			if err != nil {
+				http.Error(w, "Failed to query database", http.StatusInternalServerError)
+				log.Infof("timeline: failed to list days before %q: %v", before, err)
+				return
+			}
+			if len(dates) > timelineDays {
+				dates = dates[:timelineDays]
+				data["Older"] = dates[len(dates)-1]
+			}
+		}
+
+		days, err := store.Timeline(dates)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("timeline: failed to load %v: %v", dates, err)
+			return
+		}
+		data["Days"] = days
+
+		w.WriteHeader(http.StatusOK)
+		if err := timelineTemplate.Execute(w, data); err != nil {
+			log.Errorf("failed to render timeline: %v", err)
+		}
+	}
+}
+
+func makeCalendar(store TimelineStore) func(w http.ResponseWriter, r *http.Request) {
+	calendarTemplate := template.Must(template.ParseFS(staticContent, "static/calendar.template.html"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		// A calendar year if asked for, otherwise the year up to today.
+		today := time.Now()
+		end := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+		start := end.AddDate(-1, 0, 1)
+		year := 0
+		if y := r.FormValue("year"); y != "" {
+			var err error
+			if year, err = strconv.Atoi(y); err != nil {
+				http.Error(w, fmt.Sprintf("bad year %q", y), http.StatusBadRequest)
+				return
+			}
+			start = time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+			end = time.Date(year, time.December, 31, 0, 0, 0, 0, time.Local)
+		}
+
+		counts, err := store.Activity(start.Format(time.DateOnly), end.Format(time.DateOnly))
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("calendar: failed to count captures: %v", err)
+			return
+		}
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		if year == 0 {
+			year = end.Year()
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if err := calendarTemplate.Execute(w, map[string]any{
+			"Root":     prefix,
+			"Start":    start.Format(time.DateOnly),
+			"End":      end.Format(time.DateOnly),
+			"Total":    total,
+			"Days":     len(counts),
+			"PrevYear": year - 1,
+			"NextYear": year + 1,
+			"Weekdays": []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+			"Rows":     calendarRows(counts, start, end),
+		}); err != nil {
+			log.Errorf("failed to render calendar: %v", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spencer-p/palace/pkg/prettytime"
+)
+
+// trashPeriod is how long deleted pages stay in the trash before they are
+// purged, or zero to keep them until they are purged by hand.
+var trashPeriod = envDuration("TRASH_PURGE_AFTER", 30*24*time.Hour)
+
+// trashInterval is how often pages that have been in the trash for
+// trashPeriod are purged.
+const trashInterval = time.Hour
+
+// notTrashed is the condition on web_data for pages that aren't in the trash.
+// The search index, and so search_vocab, keeps the words of pages in the trash
+// until they are purged, so queries on it join web_data to apply this.
+const notTrashed = `deleted_at IS NULL`
+
+// TrashedPage is a page in the trash.
+type TrashedPage struct {
+	SearchResult
+	DeletedAt  time.Time
+	DeletedAgo string
+	// PurgedIn is how long until the page is purged, or empty if it stays
+	// until it is purged by hand.
+	PurgedIn string
+}
+
+// Trash lists the pages in the trash, most recently deleted first.
+func (db *DB) Trash(limit int) ([]TrashedPage, error) {
+	rows, err := db.read.Query(`
+	SELECT id, url, scraped_at, title, deleted_at
+	FROM web_data
+	WHERE deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC, id DESC
+	LIMIT ?`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var pages []TrashedPage
+	for rows.Next() {
+		var p TrashedPage
+		var scrapeTime, deleteTime string
+		if err := rows.Scan(&p.ID, &p.URL, &scrapeTime, db.opened("title", &p.SafeTitle), &deleteTime); err != nil {
+			return nil, fmt.Errorf("page %d: scan: %w", len(pages), err)
+		}
+		if p.ScrapedAt, err = timeFromDB(scrapeTime); err != nil {
+			return nil, err
+		}
+		if p.DeletedAt, err = timeFromDB(deleteTime); err != nil {
+			return nil, err
+		}
+		p.ScrapedAgo = prettytime.DurationBetween(now, p.ScrapedAt)
+		p.DeletedAgo = prettytime.DurationBetween(now, p.DeletedAt)
+		if trashPeriod > 0 {
+			p.PurgedIn = prettytime.DurationBetween(p.DeletedAt.Add(trashPeriod), now)
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+// Restore takes a page back out of the trash.
+func (db *DB) Restore(id int64) error {
+	res, err := db.Exec(`UPDATE web_data SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return fmt.Errorf("failed to restore: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Purge deletes a page in the trash for good.
+func (db *DB) Purge(id int64) error {
+	res, err := db.Exec(`DELETE FROM web_data WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return fmt.Errorf("failed to purge: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PurgeTrash purges the pages deleted before a time.
+func (db *DB) PurgeTrash(before time.Time) (int64, error) {
+	// The times have UTC offsets, which julianday understands and string
+	// comparison doesn't.
+	res, err := db.Exec(`DELETE FROM web_data WHERE deleted_at IS NOT NULL AND julianday(deleted_at) < julianday(?)`,
+		before.Format(ISO8601TZ))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// runTrashPurge purges the pages that have been in the trash for longer than
+// period, now and every interval after. It is meant to be run in the
+// background.
+func runTrashPurge(store TrashStore, period, interval time.Duration) {
+	for {
+		n, err := store.PurgeTrash(time.Now().Add(-period))
+		if err != nil {
+			log.Errorf("Failed to purge the trash: %v", err)
+		}
+		if n > 0 {
+			log.Infof("Purged %d pages from the trash", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// goBackDeleted redirects to the page the request came from, telling it which
+// page was just moved to the trash so it can offer to undo that. Zero tells it
+// nothing.
+func goBackDeleted(w http.ResponseWriter, r *http.Request, id int64) {
+	back, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || back.String() == "" {
+		goBack(w, r)
+		return
+	}
+	vals := back.Query()
+	if id == 0 {
+		vals.Del("deleted")
+	} else {
+		vals.Set("deleted", strconv.FormatInt(id, 10))
+	}
+	back.RawQuery = vals.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+// deletedFromForm is the page the user just moved to the trash, or zero.
+func deletedFromForm(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(r.FormValue("deleted"), 10, 64)
+	return id
+}
+
+func makeTrash(store TrashStore) func(w http.ResponseWriter, r *http.Request) {
+	trashTemplate := template.Must(template.ParseFS(staticContent, "static/trash.template.html"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		pages, err := store.Trash(pageSize(limit))
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("trash: failed to query: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if err := trashTemplate.Execute(w, map[string]any{
+			"Root":  prefix,
+			"Pages": pages,
+		}); err != nil {
+			log.Errorf("failed to render trash: %v", err)
+		}
+	}
+}
+
+// trashAction makes a handler that does something to the page in the path,
+// then goes back.
+func trashAction(name string, do func(id int64) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		err = do(id)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Not in the trash", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Warnf("Failed to %s page %d: %v", name, id, err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		goBackDeleted(w, r, 0)
+	}
+}
+
+func makeRestorePage(store TrashStore) func(w http.ResponseWriter, r *http.Request) {
+	return trashAction("restore", store.Restore)
+}
+
+func makePurgePage(store TrashStore) func(w http.ResponseWriter, r *http.Request) {
+	return trashAction("purge", store.Purge)
+}
+
+// makeEmptyTrash purges everything in the trash.
+func makeEmptyTrash(store TrashStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := store.PurgeTrash(time.Now())
+		if err != nil {
+			log.Warnf("Failed to empty the trash: %v", err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Emptied %d pages from the trash", n)
+		http.Redirect(w, r, prefix+"/trash", http.StatusFound)
+	}
+}
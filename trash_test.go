@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	page := testPage("https://a.com/", "Owls", "owls are birds")
+	id := mustSave(t, db, page)
+	other := mustSave(t, db, testPage("https://b.com/", "Cats", "cats are not birds"))
+	if err := db.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	visible := func() []string {
+		t.Helper()
+		found, err := db.Search(SearchQuery{Query: "birds", WithFacets: true})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		history, err := db.History(Cursor{}, 10)
+		if err != nil {
+			t.Fatalf("History: %v", err)
+		}
+		if len(found.Results) != len(history.Results) || found.Total != history.Total {
+			t.Errorf("search found %d of %d, history has %d of %d", len(found.Results), found.Total, len(history.Results), history.Total)
+		}
+		return resultURLs(found.Results)
+	}
+	if got := visible(); len(got) != 1 || got[0] != "https://b.com/" {
+		t.Errorf("after delete, found %v", got)
+	}
+	trash, err := db.Trash(10)
+	if err != nil {
+		t.Fatalf("Trash: %v", err)
+	}
+	if len(trash) != 1 || trash[0].ID != int(id) || trash[0].SafeTitle != "Owls" || trash[0].PurgedIn == "" {
+		t.Errorf("trash = %+v", trash)
+	}
+
+	if err := db.Restore(id); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := visible(); len(got) != 2 {
+		t.Errorf("after restore, found %v", got)
+	}
+	if err := db.Restore(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Restore of a page not in the trash returned %v", err)
+	}
+
+	// Saving a page again takes the place of its copy in the trash.
+	db.Delete(id)
+	again := mustSave(t, db, page)
+	if again == id {
+		t.Errorf("saving a trashed page again reused id %d", id)
+	}
+	if got := visible(); len(got) != 2 {
+		t.Errorf("after saving again, found %v", got)
+	}
+
+	db.Delete(again)
+	db.Delete(other)
+	if err := db.Purge(again); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if n, err := db.PurgeTrash(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("purging pages deleted over an hour ago purged %d: %v", n, err)
+	}
+	if n, err := db.PurgeTrash(time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("emptying the trash purged %d: %v", n, err)
+	}
+	if trash, _ := db.Trash(10); len(trash) != 0 {
+		t.Errorf("trash after purging = %+v", trash)
+	}
+}
+
+// TestTrashVocabulary checks that words only found in the trash are left out
+// of spelling corrections and completions, though the index still has them.
+func TestTrashVocabulary(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	zebras := mustSave(t, db, testPage("https://a.com/", "Zebras", "zebras have stripes"))
+	mustSave(t, db, testPage("https://b.com/", "Zebus", "zebus are cattle"))
+	if err := db.Delete(zebras); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	check := func(wantCorrection string, wantCompletions []string) {
+		t.Helper()
+		correction, err := db.DidYouMean("zebras")
+		if err != nil {
+			t.Fatalf("DidYouMean: %v", err)
+		}
+		if correction != wantCorrection {
+			t.Errorf("DidYouMean(zebras) = %q, wanted %q", correction, wantCorrection)
+		}
+		sugg, err := db.Suggest("zeb", 8)
+		if err != nil {
+			t.Fatalf("Suggest: %v", err)
+		}
+		slices.Sort(sugg.Completions)
+		if !slices.Equal(sugg.Completions, wantCompletions) {
+			t.Errorf("Suggest(zeb) completed %q, wanted %q", sugg.Completions, wantCompletions)
+		}
+	}
+	check("zebus", []string{"zebus"})
+
+	if err := db.Restore(zebras); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	check("", []string{"zebras", "zebus"})
+}
+
+func TestGoBackDeleted(t *testing.T) {
+	table := []struct {
+		referer string
+		id      int64
+		want    string
+	}{
+		{"/search?q=owls", 3, "/search?deleted=3&q=owls"},
+		{"/search?deleted=3&q=owls", 0, "/search?q=owls"},
+		{"/trash", 0, "/trash"},
+	}
+	for _, tc := range table {
+		r := httptest.NewRequest("GET", "/pages/3/delete", nil)
+		r.Header.Set("Referer", tc.referer)
+		w := httptest.NewRecorder()
+		goBackDeleted(w, r, tc.id)
+		if got := w.Header().Get("Location"); got != tc.want {
+			t.Errorf("from %q, went back to %q, wanted %q", tc.referer, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// defaultKeepVersions is how many versions of a URL are kept if no rule
+// matches it.
+const defaultKeepVersions = 5
+
+// VersionRule sets how many versions of matching URLs are kept. Pinned
+// versions are always kept, on top of these.
+type VersionRule struct {
+	ID int64
+	// Pattern is "*" for every URL, a URL prefix such as
+	// "https://wiki.example.com/docs/", or a host, which also matches its
+	// subdomains. The most specific matching rule applies.
+	Pattern string
+	// Keep is the number of versions kept, or zero to keep all of them.
+	Keep int
+}
+
+// specificity ranks matching rules, with URL prefixes above hosts above "*"
+// and longer patterns above shorter ones. It is negative if the rule doesn't
+// match rawURL.
+func (r VersionRule) specificity(rawURL string) int {
+	switch {
+	case r.Pattern == "*":
+		return 0
+	case strings.Contains(r.Pattern, "://"):
+		if strings.HasPrefix(rawURL, r.Pattern) {
+			return 2<<16 + len(r.Pattern)
+		}
+	default:
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return -1
+		}
+		// Host patterns are lower case, see parseVersionRule.
+		host := strings.ToLower(u.Hostname())
+		if host == r.Pattern || strings.HasSuffix(host, "."+r.Pattern) {
+			return 1<<16 + len(r.Pattern)
+		}
+	}
+	return -1
+}
+
+// keepVersions is how many versions of rawURL the rules keep.
+func keepVersions(rules []VersionRule, rawURL string) int {
+	keep, best := defaultKeepVersions, -1
+	for _, r := range rules {
+		if s := r.specificity(rawURL); s > best {
+			keep, best = r.Keep, s
+		}
+	}
+	return keep
+}
+
+// parseVersionRule checks a rule entered by hand and tidies its pattern.
+func parseVersionRule(pattern, keep string) (VersionRule, error) {
+	r := VersionRule{Pattern: strings.TrimSpace(pattern)}
+	if r.Pattern == "" || strings.ContainsAny(r.Pattern, " \t\n") {
+		return r, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	if !strings.Contains(r.Pattern, "://") {
+		r.Pattern = strings.ToLower(r.Pattern)
+	}
+	n, err := strconv.Atoi(keep)
+	if err != nil || n < 0 {
+		return r, fmt.Errorf("invalid number of versions %q", keep)
+	}
+	r.Keep = n
+	return r, nil
+}
+
+func (db *DB) VersionRules() ([]VersionRule, error) {
+	rows, err := db.read.Query(`SELECT id, pattern, keep FROM version_rules ORDER BY pattern`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []VersionRule
+	for rows.Next() {
+		var r VersionRule
+		if err := rows.Scan(&r.ID, &r.Pattern, &r.Keep); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// SaveVersionRule adds a rule, or replaces the rule with the same pattern.
+func (db *DB) SaveVersionRule(r VersionRule) (int64, error) {
+	var id int64
+	err := db.QueryRow(`
+	INSERT INTO version_rules(pattern, keep, created_at) VALUES (?, ?, ?)
+	ON CONFLICT(pattern) DO UPDATE SET keep = excluded.keep
+	RETURNING id`,
+		r.Pattern, r.Keep, time.Now().Format(ISO8601TZ)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save version rule: %w", err)
+	}
+	return id, nil
+}
+
+func (db *DB) DeleteVersionRule(id int64) error {
+	if _, err := db.Exec(`DELETE FROM version_rules WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete version rule: %w", err)
+	}
+	return nil
+}
+
+// ApplyVersionRules evicts old versions of every URL, for pages saved before
+// the rules changed. It returns the number of versions dropped.
+func (db *DB) ApplyVersionRules() (int64, error) {
+	rules, err := db.VersionRules()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.read.Query(`SELECT url, count(*) FROM web_data WHERE NOT pinned AND ` + notTrashed + ` GROUP BY url HAVING count(*) > 1`)
+	if err != nil {
+		return 0, err
+	}
+	var over []string
+	for rows.Next() {
+		var u string
+		var n int
+		if err := rows.Scan(&u, &n); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan: %w", err)
+		}
+		if keep := keepVersions(rules, u); keep > 0 && n > keep {
+			over = append(over, u)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// One URL at a time, so that scrapes aren't held up for long.
+	var dropped int64
+	for _, u := range over {
+		n, err := db.evict(u, keepVersions(rules, u))
+		if err != nil {
+			return dropped, fmt.Errorf("%s: %w", u, err)
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
+
+// applyVersionRules catches up with changed rules. It is meant to be run in
+// the background.
+func applyVersionRules(store VersionStore) {
+	start := time.Now()
+	n, err := store.ApplyVersionRules()
+	if err != nil {
+		log.Errorf("Failed to apply version rules: %v", err)
+	}
+	if n > 0 {
+		log.Infof("Dropped %d old versions in %v", n, time.Since(start))
+	}
+}
+
+func makeVersions(store VersionStore) func(w http.ResponseWriter, r *http.Request) {
+	versionsTemplate := template.Must(template.ParseFS(staticContent, "static/versions.template.html"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules, err := store.VersionRules()
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Infof("versions: failed to query rules: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if err := versionsTemplate.Execute(w, map[string]any{
+			"Root":    prefix,
+			"Rules":   rules,
+			"Default": defaultKeepVersions,
+		}); err != nil {
+			log.Errorf("failed to render versions: %v", err)
+		}
+	}
+}
+
+func makePostVersionRule(store VersionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rule, err := parseVersionRule(r.FormValue("pattern"), r.FormValue("keep"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := store.SaveVersionRule(rule); err != nil {
+			log.Warnf("Failed to save version rule %q: %v", rule.Pattern, err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		go applyVersionRules(store)
+		http.Redirect(w, r, prefix+"/versions", http.StatusFound)
+	}
+}
+
+func makeDeleteVersionRule(store VersionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		if err := store.DeleteVersionRule(int64(id)); err != nil {
+			log.Warnf("Failed to delete version rule %d: %v", id, err)
+			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		go applyVersionRules(store)
+		http.Redirect(w, r, prefix+"/versions", http.StatusFound)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestKeepVersions(t *testing.T) {
+	rules := []VersionRule{
+		{Pattern: "*", Keep: 3},
+		{Pattern: "example.com", Keep: 1},
+		{Pattern: "wiki.example.com", Keep: 50},
+		{Pattern: "https://wiki.example.com/archive/", Keep: 0},
+	}
+	table := []struct {
+		url  string
+		want int
+	}{
+		{"https://other.org/", 3},
+		{"https://example.com/news", 1},
+		{"https://www.example.com/news", 1},
+		{"https://notexample.com/", 3},
+		{"https://wiki.example.com/page", 50},
+		{"https://wiki.example.com/archive/2020", 0},
+		{"http://wiki.example.com/archive/2020", 50},
+		{"https://Wiki.Example.COM/page", 50},
+	}
+	for _, tc := range table {
+		if got := keepVersions(rules, tc.url); got != tc.want {
+			t.Errorf("keepVersions(%q) = %d, wanted %d", tc.url, got, tc.want)
+		}
+	}
+	if got := keepVersions(nil, "https://example.com/"); got != defaultKeepVersions {
+		t.Errorf("keepVersions with no rules = %d, wanted %d", got, defaultKeepVersions)
+	}
+}
+
+func TestVersionRules(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "palace.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	versions := func(url string) []int64 {
+		t.Helper()
+		rows, err := db.read.Query(`SELECT id FROM web_data WHERE url = ? ORDER BY id`, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			rows.Scan(&id)
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	save := func(url string, n int) int64 {
+		return mustSave(t, db, testPage(url, "page", fmt.Sprintf("version %d", n)))
+	}
+
+	rule, err := parseVersionRule("Wiki.Example.com", "1")
+	if err != nil {
+		t.Fatalf("parseVersionRule: %v", err)
+	}
+	if _, err := db.SaveVersionRule(rule); err != nil {
+		t.Fatalf("SaveVersionRule: %v", err)
+	}
+	const wiki = "https://Wiki.Example.com/page"
+	pinned := save(wiki, 1)
+	if err := db.SetPinned(pinned, true); err != nil {
+		t.Fatalf("SetPinned: %v", err)
+	}
+	save(wiki, 2)
+	trashed := save(wiki, 3)
+	if got, want := versions(wiki), []int64{pinned, trashed}; !slices.Equal(got, want) {
+		t.Errorf("after saving 3 versions, kept %v, wanted %v", got, want)
+	}
+	if err := db.Delete(trashed); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	latest := save(wiki, 4)
+	if got, want := versions(wiki), []int64{pinned, trashed, latest}; !slices.Equal(got, want) {
+		t.Errorf("after saving over a trashed version, kept %v, wanted %v", got, want)
+	}
+
+	// Lowering a rule catches up on the versions already saved.
+	const other = "https://other.org/page"
+	var saved []int64
+	for n := range 4 {
+		saved = append(saved, save(other, n))
+	}
+	if got := versions(other); !slices.Equal(got, saved) {
+		t.Errorf("with the default rule, kept %v, wanted %v", got, saved)
+	}
+	if _, err := db.SaveVersionRule(VersionRule{Pattern: "other.org", Keep: 2}); err != nil {
+		t.Fatalf("SaveVersionRule: %v", err)
+	}
+	dropped, err := db.ApplyVersionRules()
+	if err != nil {
+		t.Fatalf("ApplyVersionRules: %v", err)
+	}
+	if got, want := versions(other), saved[2:]; dropped != 2 || !slices.Equal(got, want) {
+		t.Errorf("after lowering the rule, dropped %d and kept %v, wanted %v", dropped, got, want)
+	}
+}